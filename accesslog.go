@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessFormatJSON = "json"
+	accessFormatCLF  = "clf"
+
+	defaultAccessLogBackups = 5
+)
+
+// AccessLogConfig configures the access log, which records one line per
+// closed client session for auditing. It is independent of [log]: records
+// are written whatever the log level. Records go to File, rotated once it
+// exceeds MaxSizeMB, or to syslog.
+type AccessLogConfig struct {
+	Format        string `toml:"format"`
+	File          string `toml:"file"`
+	MaxSizeMB     int    `toml:"max_size_mb"`
+	MaxBackups    int    `toml:"max_backups"`
+	Syslog        bool   `toml:"syslog"`
+	SyslogAddress string `toml:"syslog_address"`
+}
+
+func (ac AccessLogConfig) enabled() bool {
+	return ac.File != "" || ac.Syslog
+}
+
+func (ac AccessLogConfig) validate() error {
+	switch ac.Format {
+	case "", accessFormatJSON, accessFormatCLF:
+	default:
+		return fmt.Errorf("access_log: unknown format %q", ac.Format)
+	}
+	if ac.File != "" && ac.Syslog {
+		return fmt.Errorf("access_log: file and syslog cannot be combined")
+	}
+	if ac.SyslogAddress != "" && !ac.Syslog {
+		return fmt.Errorf("access_log: syslog_address requires syslog = true")
+	}
+	if ac.MaxSizeMB < 0 || ac.MaxBackups < 0 {
+		return fmt.Errorf("access_log: max_size_mb and max_backups cannot be negative")
+	}
+	return nil
+}
+
+// accessRecord summarises a closed session.
+type accessRecord struct {
+	Time        time.Time     `json:"time"`
+	ConnID      uint64        `json:"conn_id"`
+	Client      string        `json:"client"`
+	Listener    string        `json:"listener"`
+	User        string        `json:"user,omitempty"`
+	Destination string        `json:"destination,omitempty"`
+	Rule        string        `json:"rule,omitempty"`
+	Proxy       string        `json:"proxy,omitempty"`
+	Chain       []string      `json:"chain,omitempty"`
+	BytesOut    int64         `json:"bytes_out"`
+	BytesIn     int64         `json:"bytes_in"`
+	Duration    time.Duration `json:"-"`
+	DurationMS  int64         `json:"duration_ms"`
+	CloseReason string        `json:"close_reason"`
+}
+
+// clfTimeFormat is the timestamp layout of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// formatCLF renders rec in the style of the Common Log Format, with the
+// CONNECT request as the request line and the close reason as status:
+//
+//	client - user [time] "CONNECT host:port" reason bytes_in bytes_out "proxy" "rule" "hop,hop" duration_ms conn_id
+func (rec accessRecord) formatCLF() string {
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	return fmt.Sprintf("%s - %s [%s] \"CONNECT %s\" %s %d %d %q %q %q %d %d\n",
+		orDash(rec.Client), orDash(rec.User), rec.Time.Format(clfTimeFormat),
+		orDash(rec.Destination), orDash(rec.CloseReason), rec.BytesIn, rec.BytesOut,
+		orDash(rec.Proxy), orDash(rec.Rule), orDash(strings.Join(rec.Chain, ",")),
+		rec.DurationMS, rec.ConnID)
+}
+
+// accessLogger writes access records to a file or syslog.
+type accessLogger struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	format string
+}
+
+func openAccessLog(ac AccessLogConfig) (*accessLogger, error) {
+	if err := ac.validate(); err != nil {
+		return nil, err
+	}
+
+	var w io.WriteCloser
+	var err error
+	if ac.Syslog {
+		w, err = openSyslog(ac.SyslogAddress)
+	} else {
+		backups := ac.MaxBackups
+		if backups == 0 {
+			backups = defaultAccessLogBackups
+		}
+		w, err = openRotatingFile(ac.File, int64(ac.MaxSizeMB)<<20, backups)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	format := ac.Format
+	if format == "" {
+		format = accessFormatJSON
+	}
+	return &accessLogger{w: w, format: format}, nil
+}
+
+// Log writes rec. Failures are reported to the diagnostic log, as a broken
+// access log must not affect the connections being recorded.
+func (al *accessLogger) Log(rec accessRecord) {
+	rec.DurationMS = rec.Duration.Milliseconds()
+
+	var line []byte
+	if al.format == accessFormatCLF {
+		line = []byte(rec.formatCLF())
+	} else {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			slog.Error("Failed to encode access record", "error", err)
+			return
+		}
+		line = append(b, '\n')
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := al.w.Write(line); err != nil {
+		slog.Error("Failed to write access record", "error", err)
+	}
+}
+
+func (al *accessLogger) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.w.Close()
+}
+
+// rotateRetryInterval is how long a rotatingFile whose rotation failed
+// keeps appending to its current file before trying again, so that a
+// persistent failure does not shift the backups on every record.
+const rotateRetryInterval = time.Minute
+
+// rotatingFile is an append-only file that is renamed to path.1 once it
+// would grow beyond maxSize, shifting older backups up to path.<backups>.
+// A maxSize of zero disables rotation.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	backups  int
+	openFile func(name string, flag int, perm os.FileMode) (*os.File, error)
+
+	f       *os.File
+	size    int64
+	retryAt time.Time // when to rotate again after a failure
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, backups: backups, openFile: os.OpenFile}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := rf.openFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would not fit. When
+// rotation fails, p is appended to the current file anyway and rotation is
+// retried after rotateRetryInterval.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize && !time.Now().Before(rf.retryAt) {
+		if err := rf.rotate(); err != nil {
+			rf.retryAt = time.Now().Add(rotateRetryInterval)
+			slog.Warn("Failed to rotate access log, appending to the current file", "file", rf.path, "retry", rotateRetryInterval, "error", err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file to its first backup and opens a new one. The
+// current file stays open until the new one is, so that a failed step
+// leaves rf writable, and is renamed back when the new one cannot be
+// opened, so that the next rotation does not shift it.
+func (rf *rotatingFile) rotate() error {
+	os.Remove(rf.backup(rf.backups))
+	for i := rf.backups - 1; i >= 1; i-- {
+		os.Rename(rf.backup(i), rf.backup(i+1))
+	}
+	if err := os.Rename(rf.path, rf.backup(1)); err != nil {
+		return err
+	}
+	old := rf.f
+	if err := rf.open(); err != nil {
+		if undoErr := os.Rename(rf.backup(1), rf.path); undoErr != nil {
+			return fmt.Errorf("%w, and the current file stays at %s: %w", err, rf.backup(1), undoErr)
+		}
+		return err
+	}
+	return old.Close()
+}
+
+func (rf *rotatingFile) backup(i int) string {
+	return rf.path + "." + strconv.Itoa(i)
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(addr string) (io.WriteCloser, error) {
+	return nil, errors.New("access_log: syslog is not supported on this platform")
+}
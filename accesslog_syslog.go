@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// openSyslog connects to the syslog daemon at addr, given as
+// network://host:port, or host:port for UDP, or to the local daemon when
+// addr is empty.
+func openSyslog(addr string) (io.WriteCloser, error) {
+	var network string
+	if addr != "" {
+		network = "udp"
+		if n, a, ok := strings.Cut(addr, "://"); ok {
+			network, addr = n, a
+		}
+	}
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "proxs")
+}
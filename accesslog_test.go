@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAccessRecord() accessRecord {
+	return accessRecord{
+		Time:        time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ConnID:      7,
+		Client:      "127.0.0.1:50000",
+		Listener:    "127.0.0.1:1080",
+		User:        "alice",
+		Destination: "db.internal:5432",
+		Rule:        "*.internal",
+		Proxy:       "env1",
+		Chain:       []string{"me@bastion:22", "me@env1:22"},
+		BytesOut:    100,
+		BytesIn:     2000,
+		Duration:    1500 * time.Millisecond,
+		CloseReason: closeClient,
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		check  func(t *testing.T, line string)
+	}{
+		{accessFormatJSON, func(t *testing.T, line string) {
+			var rec map[string]any
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("invalid JSON record %q: %v", line, err)
+			}
+			for key, want := range map[string]any{
+				"conn_id":      float64(7),
+				"user":         "alice",
+				"destination":  "db.internal:5432",
+				"rule":         "*.internal",
+				"proxy":        "env1",
+				"bytes_in":     float64(2000),
+				"duration_ms":  float64(1500),
+				"close_reason": closeClient,
+			} {
+				if rec[key] != want {
+					t.Errorf("record[%q] = %v, expected %v", key, rec[key], want)
+				}
+			}
+		}},
+		{accessFormatCLF, func(t *testing.T, line string) {
+			expected := `127.0.0.1:50000 - alice [01/Mar/2024:12:30:00 +0000] "CONNECT db.internal:5432" client_closed 2000 100 "env1" "*.internal" "me@bastion:22,me@env1:22" 1500 7` + "\n"
+			if line != expected {
+				t.Errorf("CLF record = %q, expected %q", line, expected)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			al, err := openAccessLog(AccessLogConfig{Format: tt.format, File: path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			al.Log(testAccessRecord())
+			al.Close()
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, string(data))
+		})
+	}
+}
+
+func TestAccessLogConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		ac      AccessLogConfig
+		wantErr bool
+	}{
+		{"file", AccessLogConfig{File: "access.log"}, false},
+		{"syslog", AccessLogConfig{Syslog: true, SyslogAddress: "udp://10.0.0.5:514"}, false},
+		{"unknown format", AccessLogConfig{File: "access.log", Format: "xml"}, true},
+		{"file and syslog", AccessLogConfig{File: "access.log", Syslog: true}, true},
+		{"address without syslog", AccessLogConfig{SyslogAddress: "10.0.0.5:514"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.ac.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+
+	for name, expected := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("%s = %q, expected %q", filepath.Base(name), data, expected)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups, stat error = %v", err)
+	}
+}
+
+func TestRotatingFileRenameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	// A non-empty directory in the way of the backup makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write(%q) = %v, expected the record to be kept", line, err)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "first\nsecond\n" {
+		t.Errorf("access.log = %q, expected both records", data)
+	}
+
+	// Rotation is retried once the backup can be written and the retry
+	// interval has passed.
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	rf.retryAt = time.Time{}
+	if _, err := rf.Write([]byte("third\n")); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{path: "third\n", path + ".1": "first\nsecond\n"} {
+		if data, _ := os.ReadFile(name); string(data) != expected {
+			t.Errorf("%s = %q, expected %q", filepath.Base(name), data, expected)
+		}
+	}
+}
+
+func TestRotatingFileOpenFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	writeTestFile(t, path+".1", "backup 1\n")
+	writeTestFile(t, path+".2", "backup 2\n")
+
+	// The rename to path.1 succeeds, but the new file cannot be opened.
+	rf.openFile = func(string, int, os.FileMode) (*os.File, error) { return nil, os.ErrPermission }
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write(%q) = %v, expected the record to be kept", line, err)
+		}
+	}
+	expected := map[string]string{path: "first\nsecond\nthird\n", path + ".1": "", path + ".2": "backup 1\n"}
+	for name, want := range expected {
+		if data, _ := os.ReadFile(name); string(data) != want {
+			t.Errorf("%s = %q, expected %q", filepath.Base(name), data, want)
+		}
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("expected the current file to be renamed back from access.log.1, stat error = %v", err)
+	}
+}
+
+func TestSessionCloseReason(t *testing.T) {
+	var ss sessions
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	sess, ctx := ss.add(context.Background(), server, "127.0.0.1:1080")
+	ss.kill(sess.ID)
+	sess.setCloseReason(closeReasonFor(context.Cause(ctx)))
+	sess.setCloseReason(closeClient)
+
+	if rec := sess.accessRecord(); rec.CloseReason != closeKilled {
+		t.Errorf("accessRecord().CloseReason = %q, expected %q", rec.CloseReason, closeKilled)
+	}
+	ss.remove(sess)
+}
+
+func TestSessionAccessRecordDefaults(t *testing.T) {
+	var ss sessions
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	sess, _ := ss.add(context.Background(), server, "127.0.0.1:1080")
+	defer ss.remove(sess)
+	if rec := sess.accessRecord(); rec.CloseReason != closeAborted || !strings.Contains(rec.Client, "pipe") {
+		t.Errorf("unexpected record %+v", rec)
+	}
+}
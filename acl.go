@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var destinationDeniedError = errors.New("destination denied")
+
+// ACL restricts the destinations clients may connect to. A destination is
+// denied when its host matches one of DenyHosts or its port is in one of
+// DenyPorts. Otherwise, when AllowHosts or AllowPorts are set, its host or
+// port respectively must match one of them. Host patterns are shell
+// patterns as in target_addrs, or IP addresses and CIDR prefixes such as
+// "169.254.0.0/16", which match IP address destinations however they are
+// written, but not hostnames, which the SSH server resolves.
+type ACL struct {
+	AllowHosts []string    `toml:"allow_hosts"`
+	DenyHosts  []string    `toml:"deny_hosts"`
+	AllowPorts []PortRange `toml:"allow_ports"`
+	DenyPorts  []PortRange `toml:"deny_ports"`
+}
+
+func (acl ACL) validate() error {
+	for _, pattern := range slices.Concat(acl.AllowHosts, acl.DenyHosts) {
+		if strings.Contains(pattern, "/") {
+			if _, err := netip.ParsePrefix(pattern); err != nil {
+				return fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+			}
+		} else if _, ok := hostPrefix(pattern); !ok && numericHost(strings.ToLower(pattern)) {
+			return fmt.Errorf("invalid host pattern %q: IP addresses must be written in dotted decimal or IPv6 notation", pattern)
+		} else if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// check returns nil when the ACL allows connections to host on port, or an
+// error wrapping destinationDeniedError that names the rule denying them.
+// Port rules are skipped when port is zero, which stands for any port.
+//
+// IP addresses are compared in their canonical form, so that IPv4-mapped
+// IPv6 addresses match IPv4 rules. Hosts the SSH server may read as an
+// IPv4 address written in another form, such as "2852039166", "0xa9fea9fe"
+// or "169.254.43518", are denied when the ACL has host rules, since they
+// could otherwise slip past them.
+func (acl ACL) check(host string, port uint16) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.WithZone("").Unmap().String()
+	} else if numericHost(host) && len(acl.AllowHosts)+len(acl.DenyHosts) > 0 {
+		return fmt.Errorf("%w: %q is not an IP address in canonical form", destinationDeniedError, host)
+	}
+	if i := slices.IndexFunc(acl.DenyHosts, func(p string) bool { return hostMatches(p, host) }); i >= 0 {
+		return fmt.Errorf("%w by deny_hosts %q", destinationDeniedError, acl.DenyHosts[i])
+	}
+	if len(acl.AllowHosts) > 0 && !slices.ContainsFunc(acl.AllowHosts, func(p string) bool { return hostMatches(p, host) }) {
+		return fmt.Errorf("%w: host not in allow_hosts", destinationDeniedError)
+	}
+	if port == 0 {
+		return nil
+	}
+	if i := slices.IndexFunc(acl.DenyPorts, func(pr PortRange) bool { return pr.contains(port) }); i >= 0 {
+		return fmt.Errorf("%w by deny_ports %s", destinationDeniedError, acl.DenyPorts[i])
+	}
+	if len(acl.AllowPorts) > 0 && !slices.ContainsFunc(acl.AllowPorts, func(pr PortRange) bool { return pr.contains(port) }) {
+		return fmt.Errorf("%w: port not in allow_ports", destinationDeniedError)
+	}
+	return nil
+}
+
+// hostMatches reports whether the lower-case host matches pattern. IP
+// addresses and CIDR prefixes only match IP addresses, including
+// IPv4-mapped IPv6 ones.
+func hostMatches(pattern, host string) bool {
+	if prefix, ok := hostPrefix(pattern); ok {
+		addr, err := netip.ParseAddr(host)
+		return err == nil && prefix.Contains(addr.WithZone("").Unmap())
+	}
+	match, _ := filepath.Match(strings.ToLower(pattern), host)
+	return match
+}
+
+// hostPrefix parses a host pattern that is a CIDR prefix or an IP address,
+// which is a prefix of its full length.
+func hostPrefix(pattern string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(pattern); err == nil {
+		addr := prefix.Addr().Unmap()
+		return netip.PrefixFrom(addr, max(prefix.Bits()-(prefix.Addr().BitLen()-addr.BitLen()), 0)).Masked(), true
+	}
+	if addr, err := netip.ParseAddr(pattern); err == nil {
+		addr = addr.WithZone("").Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+// numericHost reports whether host, which is not an IP address in canonical
+// form, would still be read as an IPv4 address by inet_aton(3) or a URL
+// parser: its last label is a decimal, octal or hexadecimal number.
+func numericHost(host string) bool {
+	last := host[strings.LastIndex(host, ".")+1:]
+	if hex, ok := strings.CutPrefix(last, "0x"); ok {
+		return strings.Trim(hex, "0123456789abcdef") == ""
+	}
+	return last != "" && strings.Trim(last, "0123456789") == ""
+}
+
+// checkDestination applies the global ACL and then that of sp to a
+// connection to host on port.
+func (c *Config) checkDestination(sp sshProxy, host string, port uint16) error {
+	if err := c.ACL.check(host, port); err != nil {
+		return fmt.Errorf("global ACL: %w", err)
+	}
+	if err := sp.ACL.check(host, port); err != nil {
+		return fmt.Errorf("proxy %s ACL: %w", sp.Name, err)
+	}
+	return nil
+}
+
+// PortRange is a destination port or an inclusive range of ports, written
+// in the configuration as 22 or "8000-8999".
+type PortRange struct {
+	Low, High uint16
+}
+
+func (pr *PortRange) UnmarshalTOML(v any) error {
+	var low, high string
+	switch v := v.(type) {
+	case int64:
+		low = strconv.FormatInt(v, 10)
+		high = low
+	case string:
+		var ok bool
+		if low, high, ok = strings.Cut(v, "-"); !ok {
+			high = low
+		}
+	default:
+		return fmt.Errorf("invalid port %v: expected a number or a range", v)
+	}
+	l, errLow := strconv.ParseUint(strings.TrimSpace(low), 10, 16)
+	h, errHigh := strconv.ParseUint(strings.TrimSpace(high), 10, 16)
+	if errLow != nil || errHigh != nil || l == 0 || l > h {
+		return fmt.Errorf("invalid port range %v", v)
+	}
+	pr.Low, pr.High = uint16(l), uint16(h)
+	return nil
+}
+
+func (pr PortRange) contains(port uint16) bool {
+	return port >= pr.Low && port <= pr.High
+}
+
+func (pr PortRange) String() string {
+	if pr.Low == pr.High {
+		return strconv.Itoa(int(pr.Low))
+	}
+	return fmt.Sprintf("%d-%d", pr.Low, pr.High)
+}
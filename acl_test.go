@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bean1310/proxs/internal/sshtest"
+)
+
+func TestACLCheck(t *testing.T) {
+	acl := ACL{
+		AllowHosts: []string{"*.internal", "10.0.0.0/8"},
+		DenyHosts:  []string{"vault.internal", "10.0.0.1/32"},
+		AllowPorts: []PortRange{{22, 22}, {443, 443}, {8000, 8999}},
+		DenyPorts:  []PortRange{{8080, 8080}},
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		port    uint16
+		allowed bool
+	}{
+		{"Allowed host and port", "db.internal", 22, true},
+		{"Allowed port range", "db.internal", 8443, true},
+		{"Allowed CIDR", "10.1.2.3", 443, true},
+		{"Allowed IPv4-mapped address", "::ffff:10.1.2.3", 443, true},
+		{"Any port", "db.internal", 0, true},
+		{"Denied host", "vault.internal", 443, false},
+		{"Denied host in upper case with trailing dot", "VAULT.internal.", 443, false},
+		{"Denied CIDR", "10.0.0.1", 443, false},
+		{"Denied port in allowed range", "db.internal", 8080, false},
+		{"Host not allowed", "example.com", 443, false},
+		{"Port not allowed", "db.internal", 25, false},
+		{"Hostname not matched by CIDR", "10.0.0.1.nip.io", 443, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := acl.check(tt.host, tt.port)
+			if tt.allowed && err != nil {
+				t.Errorf("check(%q, %d) = %v, expected nil", tt.host, tt.port, err)
+			}
+			if !tt.allowed && !errors.Is(err, destinationDeniedError) {
+				t.Errorf("check(%q, %d) = %v, expected %v", tt.host, tt.port, err, destinationDeniedError)
+			}
+		})
+	}
+
+	if err := (ACL{}).check("anything.example.com", 25); err != nil {
+		t.Errorf("empty ACL denied a destination: %v", err)
+	}
+}
+
+func TestACLCheckAddressForms(t *testing.T) {
+	acls := map[string]ACL{
+		"address":       {DenyHosts: []string{"169.254.169.254"}},
+		"prefix":        {DenyHosts: []string{"169.254.0.0/16"}},
+		"mapped prefix": {DenyHosts: []string{"::ffff:169.254.0.0/112"}},
+		"allow list":    {AllowHosts: []string{"*.internal", "10.0.0.0/8"}},
+	}
+
+	tests := []struct {
+		name string
+		host string
+	}{
+		{"IPv4-mapped IPv6", "::ffff:169.254.169.254"},
+		{"IPv4-mapped IPv6 in hex", "::ffff:a9fe:a9fe"},
+		{"Decimal", "2852039166"},
+		{"Hexadecimal", "0xa9fea9fe"},
+		{"Octal", "0251.0376.0251.0376"},
+		{"Two parts", "169.254.43518"},
+		{"Trailing dot", "169.254.169.254."},
+	}
+
+	for name, acl := range acls {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				if err := acl.check(tt.host, 80); !errors.Is(err, destinationDeniedError) {
+					t.Errorf("check(%q) = %v, expected %v", tt.host, err, destinationDeniedError)
+				}
+			})
+		}
+	}
+
+	for _, host := range []string{"169.254.169.253", "10.1.2.3", "db.internal", "2852039166.nip.io"} {
+		if err := acls["address"].check(host, 80); err != nil {
+			t.Errorf("check(%q) = %v, expected nil", host, err)
+		}
+	}
+	if err := (ACL{}).check("2852039166", 80); err != nil {
+		t.Errorf("ACL without host rules denied a numeric host: %v", err)
+	}
+}
+
+func TestACLConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		toml     string
+		expected ACL
+		wantErr  bool
+	}{
+		{
+			name:     "Ports and ranges",
+			toml:     `allow_ports = [22, "8000-8999", " 443 "]`,
+			expected: ACL{AllowPorts: []PortRange{{22, 22}, {8000, 8999}, {443, 443}}},
+		},
+		{
+			name:     "Host patterns",
+			toml:     `deny_hosts = ["169.254.169.254", "169.254.0.0/16", "metadata.*"]`,
+			expected: ACL{DenyHosts: []string{"169.254.169.254", "169.254.0.0/16", "metadata.*"}},
+		},
+		{name: "Port zero", toml: `deny_ports = [0]`, wantErr: true},
+		{name: "Port out of range", toml: `deny_ports = [65536]`, wantErr: true},
+		{name: "Reversed range", toml: `deny_ports = ["9000-8000"]`, wantErr: true},
+		{name: "Invalid CIDR", toml: `deny_hosts = ["10.0.0.0/33"]`, wantErr: true},
+		{name: "Non-canonical address", toml: `deny_hosts = ["0xa9fea9fe"]`, wantErr: true},
+		{name: "Invalid pattern", toml: `allow_hosts = ["[a-"]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var acl ACL
+			_, err := toml.Decode(tt.toml, &acl)
+			if err == nil {
+				err = acl.validate()
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", acl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(acl, tt.expected) {
+				t.Errorf("decoded %+v, expected %+v", acl, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEndToEndACL(t *testing.T) {
+	sshtest.UseAgent(t)
+	target := sshtest.NewEchoServer(t)
+	proxyHost := sshtest.NewServer(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	addr := startProxs(t, sshHost("proxyhost", proxyHost, ""), `
+[acl]
+deny_hosts = ["169.254.0.0/16"]
+
+[proxy.env1]
+host = "proxyhost"
+target_addrs = ["127.0.0.1", "169.254.169.254", "localhost"]
+acl = { deny_hosts = ["localhost"], allow_ports = [`+port+`] }
+`)
+
+	conn, err := socksDial(t, addr, target)
+	if err != nil {
+		t.Fatalf("allowed destination: %v", err)
+	}
+	if got := echo(t, conn, "hello"); got != "hello" {
+		t.Errorf("echoed %q, expected %q", got, "hello")
+	}
+	conn.Close()
+
+	for _, dest := range []string{"169.254.169.254:80", net.JoinHostPort("localhost", port), "127.0.0.1:1"} {
+		if _, err := socksDial(t, addr, dest); err == nil || !strings.Contains(err.Error(), "connection not allowed by ruleset") {
+			t.Errorf("SOCKS5 dial to %s: error = %v, expected connection not allowed", dest, err)
+		}
+		if code := connectStatus(t, addr, dest); code != http.StatusForbidden {
+			t.Errorf("CONNECT to %s: status = %d, expected %d", dest, code, http.StatusForbidden)
+		}
+	}
+	if forwarded := proxyHost.Forwarded(); len(forwarded) != 1 {
+		t.Errorf("proxy host opened channels to %v, expected only the allowed destination", forwarded)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// adminReconnectTimeout bounds how long a reconnect requested through the
+// admin endpoint may take.
+const adminReconnectTimeout = 30 * time.Second
+
+// AdminConfig enables the local admin endpoint, which `proxs status` uses
+// to query a running daemon. It is disabled unless Socket or Address is
+// set. Address must be a loopback address, as the endpoint has no
+// authentication of its own.
+type AdminConfig struct {
+	Socket     string `toml:"socket"`
+	Address    string `toml:"address"`
+	SocketMode string `toml:"socket_mode"`
+}
+
+func (ac AdminConfig) enabled() bool {
+	return ac.Socket != "" || ac.Address != ""
+}
+
+func (ac AdminConfig) validate() error {
+	if ac.Socket != "" && ac.Address != "" {
+		return errors.New("admin: socket and address are mutually exclusive")
+	}
+	if ac.Address != "" {
+		host, _, err := net.SplitHostPort(ac.Address)
+		if err != nil {
+			return fmt.Errorf("admin: invalid address %q: %w", ac.Address, err)
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("admin: address %q is not a loopback address", ac.Address)
+		}
+	}
+	if _, err := (ListenerConfig{SocketMode: ac.SocketMode}).socketMode(); err != nil {
+		return fmt.Errorf("admin: %w", err)
+	}
+	return nil
+}
+
+func (ac AdminConfig) listen() (net.Listener, error) {
+	if ac.Socket != "" {
+		return listen(ListenerConfig{Socket: ac.Socket, SocketMode: ac.SocketMode})
+	}
+	return net.Listen("tcp", ac.Address)
+}
+
+type statusResponse struct {
+	Version     string           `json:"version"`
+	PID         int              `json:"pid"`
+	StartedAt   time.Time        `json:"started_at"`
+	Listeners   []listenerStatus `json:"listeners"`
+	Connections int              `json:"connections"`
+	Proxies     []proxyStatus    `json:"proxies"`
+}
+
+type listenerStatus struct {
+	Network  string `json:"network"`
+	Address  string `json:"address"`
+	Protocol string `json:"protocol"`
+}
+
+type proxyStatus struct {
+	Name        string   `json:"name"`
+	Host        string   `json:"host,omitempty"`
+	Hosts       []string `json:"hosts,omitempty"`
+	Chain       []string `json:"chain"`
+	TargetAddrs []string `json:"target_addrs"`
+	poolStats
+}
+
+// routeEntry is one line of the routing table: destinations matching
+// TargetAddrs are sent through Proxy. Entries are evaluated in order.
+type routeEntry struct {
+	Proxy       string   `json:"proxy"`
+	TargetAddrs []string `json:"target_addrs"`
+	Chain       []string `json:"chain"`
+}
+
+type listenerRoutes struct {
+	Address string       `json:"address"`
+	Routes  []routeEntry `json:"routes"`
+}
+
+func (s *server) status() statusResponse {
+	st := statusResponse{
+		Version:     version(),
+		PID:         os.Getpid(),
+		StartedAt:   s.started,
+		Connections: s.sessions.count(),
+		Proxies:     s.proxyStatuses(),
+	}
+	for _, ln := range s.listeners {
+		st.Listeners = append(st.Listeners, listenerStatus{
+			Network:  ln.Addr().Network(),
+			Address:  ln.Addr().String(),
+			Protocol: ln.cfg.Protocol,
+		})
+	}
+	return st
+}
+
+func (s *server) proxyStatuses() []proxyStatus {
+	var statuses []proxyStatus
+	for _, proxy := range s.config().proxiesFor(ListenerConfig{}) {
+		statuses = append(statuses, proxyStatus{
+			Name:        proxy.Name,
+			Host:        proxy.Host,
+			Hosts:       proxy.Hosts,
+			Chain:       chainStrings(proxy.Connection),
+			TargetAddrs: proxy.TargetAddrs,
+			poolStats:   proxy.pool.stats(),
+		})
+	}
+	return statuses
+}
+
+// routes returns the routing table of every listener.
+func (s *server) routes() []listenerRoutes {
+	cfg := s.config()
+	var routes []listenerRoutes
+	for _, ln := range s.listeners {
+		lr := listenerRoutes{Address: ln.Addr().String()}
+		for _, proxy := range cfg.proxiesFor(cfg.listenerFor(ln.cfg)) {
+			lr.Routes = append(lr.Routes, routeEntry{
+				Proxy:       proxy.Name,
+				TargetAddrs: proxy.TargetAddrs,
+				Chain:       chainStrings(proxy.Connection),
+			})
+		}
+		routes = append(routes, lr)
+	}
+	return routes
+}
+
+func chainStrings(sc *sshConnection) []string {
+	if sc == nil {
+		return nil
+	}
+	var hops []string
+	for _, hop := range sc.Chain() {
+		hops = append(hops, hop.String())
+	}
+	return hops
+}
+
+func (s *server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.status())
+	})
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.sessions.list())
+	})
+	mux.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !s.sessions.kill(id) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no active connection %d", id))
+			return
+		}
+		slog.Info("Connection killed through admin endpoint", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /proxies", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.proxyStatuses())
+	})
+	mux.HandleFunc("POST /proxies/{name}/reconnect", func(w http.ResponseWriter, r *http.Request) {
+		proxy, ok := s.config().Proxies[r.PathValue("name")]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no proxy %q", r.PathValue("name")))
+			return
+		}
+		slog.Info("Reconnecting proxy through admin endpoint", "proxy", proxy.Name)
+
+		ctx, cancel := context.WithTimeout(r.Context(), adminReconnectTimeout)
+		defer cancel()
+		if err := proxy.pool.Reconnect(ctx); err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, proxy.pool.stats())
+	})
+	mux.HandleFunc("GET /hops", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, sharedHops.stats())
+	})
+	mux.HandleFunc("GET /routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.routes())
+	})
+	mux.Handle("GET /metrics", metrics.handler())
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Reload(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// loopbackOnly rejects requests whose Host header does not name a loopback
+// address, so that a web page cannot reach a TCP admin endpoint through
+// DNS rebinding.
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q is not allowed", r.Host))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// notFromBrowser rejects requests sent by a web page, which carry an Origin
+// header or a Sec-Fetch-Site other than none or same-origin, so that a
+// page cannot trigger reloads, reconnects or kills through a simple
+// cross-origin request. Clients such as proxs status and curl send neither.
+func notFromBrowser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			writeError(w, http.StatusForbidden, fmt.Errorf("requests from origin %q are not allowed", origin))
+			return
+		}
+		switch site := r.Header.Get("Sec-Fetch-Site"); site {
+		case "", "none", "same-origin":
+		default:
+			writeError(w, http.StatusForbidden, fmt.Errorf("%s requests are not allowed", site))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write admin response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// ServeAdmin starts the admin endpoint. It is stopped by Shutdown.
+func (s *server) ServeAdmin(ac AdminConfig) error {
+	ln, err := ac.listen()
+	if err != nil {
+		return err
+	}
+	slog.Info("Admin endpoint listening", "address", ln.Addr().String())
+
+	handler := notFromBrowser(s.adminHandler())
+	if ac.Address != "" {
+		handler = loopbackOnly(handler)
+	}
+	s.admin = &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.admin.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin endpoint stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// adminClient returns an HTTP client for the admin endpoint of a running
+// daemon, and the base URL to send requests to.
+func adminClient(ac AdminConfig) (*http.Client, string, error) {
+	switch {
+	case ac.Socket != "":
+		return &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", ac.Socket)
+				},
+			},
+		}, "http://localhost", nil
+	case ac.Address != "":
+		return &http.Client{Timeout: 10 * time.Second}, "http://" + ac.Address, nil
+	default:
+		return nil, "", errors.New("admin endpoint is not configured; set [admin] socket or address in config.toml")
+	}
+}
+
+// fetchStatus queries the status of a running daemon.
+func fetchStatus(ac AdminConfig) (statusResponse, error) {
+	var st statusResponse
+
+	client, base, err := adminClient(ac)
+	if err != nil {
+		return st, err
+	}
+	resp, err := client.Get(base + "/status")
+	if err != nil {
+		return st, fmt.Errorf("failed to reach proxs: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("admin endpoint returned %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	return st, err
+}
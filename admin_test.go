@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path string, v any) int {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: invalid JSON %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminConnections(t *testing.T) {
+	srv := newServer(&Config{Proxies: map[string]sshProxy{}}, nil)
+	h := srv.adminHandler()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	sess, ctx := srv.sessions.add(context.Background(), server, "127.0.0.1:1080")
+	sess.setRequest(clientRequest{Host: "db.internal", Port: 5432, User: "alice"})
+	sess.setRoute(sshProxy{Name: "env1"}, "*.internal")
+	sess.bytesOut.Add(10)
+
+	var conns []sessionInfo
+	if code := adminRequest(t, h, "GET", "/connections", &conns); code != http.StatusOK {
+		t.Fatalf("GET /connections returned %d", code)
+	}
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(conns))
+	}
+	if c := conns[0]; c.Destination != "db.internal:5432" || c.Proxy != "env1" || c.User != "alice" || c.BytesOut != 10 {
+		t.Errorf("unexpected connection %+v", c)
+	}
+
+	if code := adminRequest(t, h, "DELETE", "/connections/42", nil); code != http.StatusNotFound {
+		t.Errorf("DELETE of an unknown connection returned %d, expected 404", code)
+	}
+	if code := adminRequest(t, h, "DELETE", "/connections/1", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE /connections/1 returned %d, expected 204", code)
+	}
+	if ctx.Err() == nil {
+		t.Error("expected the killed connection's context to be cancelled")
+	}
+
+	srv.sessions.remove(sess)
+	if code := adminRequest(t, h, "GET", "/connections", &conns); code != http.StatusOK || len(conns) != 0 {
+		t.Errorf("expected no connections after removal, got %d (%d)", len(conns), code)
+	}
+}
+
+func TestAdminProxiesAndRoutes(t *testing.T) {
+	configPath := writeTestConfig(t, "")
+	cfg, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := newServer(cfg, []boundListener{{ln, ListenerConfig{Protocol: protocolSOCKS5, Proxies: []string{"env2"}}}})
+	h := srv.adminHandler()
+
+	var proxies []proxyStatus
+	if code := adminRequest(t, h, "GET", "/proxies", &proxies); code != http.StatusOK {
+		t.Fatalf("GET /proxies returned %d", code)
+	}
+	if len(proxies) != 2 || proxies[0].Name != "env1" || len(proxies[0].Hops) != 2 || proxies[0].Connected {
+		t.Errorf("unexpected proxies %+v", proxies)
+	}
+
+	var routes []listenerRoutes
+	if code := adminRequest(t, h, "GET", "/routes", &routes); code != http.StatusOK {
+		t.Fatalf("GET /routes returned %d", code)
+	}
+	if len(routes) != 1 || len(routes[0].Routes) != 1 || routes[0].Routes[0].Proxy != "env2" {
+		t.Errorf("unexpected routes %+v", routes)
+	}
+
+	if code := adminRequest(t, h, "POST", "/proxies/unknown/reconnect", nil); code != http.StatusNotFound {
+		t.Errorf("reconnect of an unknown proxy returned %d, expected 404", code)
+	}
+
+	// Without a loader, reloading is refused.
+	if code := adminRequest(t, h, "POST", "/reload", nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /reload returned %d, expected 422", code)
+	}
+	srv.load = runOptions{ConfigPath: configPath}.loadConfig
+	if code := adminRequest(t, h, "POST", "/reload", nil); code != http.StatusNoContent {
+		t.Errorf("POST /reload returned %d, expected 204", code)
+	}
+}
+
+func TestAdminLoopbackOnly(t *testing.T) {
+	h := loopbackOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for host, expected := range map[string]int{
+		"127.0.0.1:9090":    http.StatusOK,
+		"[::1]:9090":        http.StatusOK,
+		"localhost:9090":    http.StatusOK,
+		"evil.example:9090": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/status", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("Host %s returned %d, expected %d", host, rec.Code, expected)
+		}
+	}
+}
+
+func TestAdminNotFromBrowser(t *testing.T) {
+	h := notFromBrowser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		expected int
+	}{
+		{"CLI", "", "", http.StatusOK},
+		{"Typed in the address bar", "Sec-Fetch-Site", "none", http.StatusOK},
+		{"Cross-origin page", "Origin", "https://evil.example", http.StatusForbidden},
+		{"Opaque origin", "Origin", "null", http.StatusForbidden},
+		{"Cross-site fetch", "Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		{"Other localhost port", "Sec-Fetch-Site", "same-site", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, path := range []string{"/reload", "/proxies/env1/reconnect"} {
+				req := httptest.NewRequest("POST", path, strings.NewReader("x=1"))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				if tt.header != "" {
+					req.Header.Set(tt.header, tt.value)
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != tt.expected {
+					t.Errorf("POST %s returned %d, expected %d", path, rec.Code, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		ac      AdminConfig
+		wantErr bool
+	}{
+		{AdminConfig{}, false},
+		{AdminConfig{Address: "127.0.0.1:9090"}, false},
+		{AdminConfig{Address: "0.0.0.0:9090"}, true},
+		{AdminConfig{Address: "localhost:9090"}, true},
+		{AdminConfig{Socket: "/tmp/a.sock", Address: "127.0.0.1:9090"}, true},
+	} {
+		if err := tt.ac.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) = %v, wantErr %v", tt.ac, err, tt.wantErr)
+		}
+	}
+}
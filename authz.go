@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// validateClients checks AllowClients, which lists the IP addresses and
+// CIDR prefixes of the clients allowed to connect to a TCP listener.
+func (lc ListenerConfig) validateClients() error {
+	if len(lc.AllowClients) > 0 && lc.Socket != "" {
+		return fmt.Errorf("allow_clients cannot be set on a socket listener")
+	}
+	for _, client := range lc.AllowClients {
+		if _, err := parseClientPrefix(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseClientPrefix parses an entry of allow_clients. A bare address is a
+// prefix of its full length.
+func parseClientPrefix(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid client address or prefix %q", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// allowsClient reports whether a client connecting from addr may use the
+// listener. Clients of socket listeners, and every client when
+// AllowClients is empty, are allowed.
+func (lc ListenerConfig) allowsClient(addr net.Addr) bool {
+	if len(lc.AllowClients) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return lc.Socket != ""
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	return slices.ContainsFunc(lc.AllowClients, func(client string) bool {
+		prefix, err := parseClientPrefix(client)
+		return err == nil && prefix.Contains(ip)
+	})
+}
+
+// validateAccess checks Groups and Access against the users of the
+// listener and the proxies it may route through. Access maps a user, or a
+// group written "@name", to the proxies it may use: either a proxy name,
+// for all its routes, or "proxy/pattern" for the route of one pattern of
+// its target_addrs.
+func (lc ListenerConfig) validateAccess(proxies map[string]sshProxy) error {
+	if (len(lc.Groups) > 0 || len(lc.Access) > 0) && len(lc.Users) == 0 {
+		return fmt.Errorf("groups and access require users")
+	}
+	for group, members := range lc.Groups {
+		for _, user := range members {
+			if _, ok := lc.Users[user]; !ok {
+				return fmt.Errorf("group %q: unknown user %q", group, user)
+			}
+		}
+	}
+	for who, grants := range lc.Access {
+		if group, ok := strings.CutPrefix(who, "@"); ok {
+			if _, ok := lc.Groups[group]; !ok {
+				return fmt.Errorf("access: unknown group %q", group)
+			}
+		} else if _, ok := lc.Users[who]; !ok {
+			return fmt.Errorf("access: unknown user %q", who)
+		}
+		for _, grant := range grants {
+			name, pattern, _ := strings.Cut(grant, "/")
+			sp, ok := proxies[name]
+			if !ok || (len(lc.Proxies) > 0 && !slices.Contains(lc.Proxies, name)) {
+				return fmt.Errorf("access for %s: unknown proxy %q", who, name)
+			}
+			if pattern != "" && !slices.Contains(sp.TargetAddrs, pattern) {
+				return fmt.Errorf("access for %s: %q is not in the target_addrs of proxy %s", who, pattern, name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkAccess returns nil when user may use the route of pattern rule of
+// proxy sp, or an error wrapping destinationDeniedError. Every user may use
+// every route when Access is empty; otherwise a user may only use the
+// routes granted to it or to one of its groups.
+func (lc ListenerConfig) checkAccess(user string, sp sshProxy, rule string) error {
+	if len(lc.Access) == 0 {
+		return nil
+	}
+	grants := slices.Clone(lc.Access[user])
+	for group, members := range lc.Groups {
+		if slices.Contains(members, user) {
+			grants = append(grants, lc.Access["@"+group]...)
+		}
+	}
+	if slices.Contains(grants, sp.Name) || slices.Contains(grants, sp.Name+"/"+rule) {
+		return nil
+	}
+	return fmt.Errorf("%w: user %q may not use proxy %s for %q", destinationDeniedError, user, sp.Name, rule)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bean1310/proxs/internal/sshtest"
+	"golang.org/x/net/proxy"
+)
+
+func TestAllowsClient(t *testing.T) {
+	lc := ListenerConfig{Address: "0.0.0.0", Port: 1080, AllowClients: []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"}}
+
+	tests := []struct {
+		name    string
+		addr    net.Addr
+		allowed bool
+	}{
+		{"Address in prefix", &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 50000}, true},
+		{"Single address", &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 50000}, true},
+		{"IPv4-mapped address", &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 50000}, true},
+		{"IPv6 prefix", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}, true},
+		{"Address outside prefixes", &net.TCPAddr{IP: net.ParseIP("192.0.2.8"), Port: 50000}, false},
+		{"Loopback", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000}, false},
+		{"Unix client", &net.UnixAddr{Name: "@", Net: "unix"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lc.allowsClient(tt.addr); got != tt.allowed {
+				t.Errorf("allowsClient(%v) = %v, expected %v", tt.addr, got, tt.allowed)
+			}
+		})
+	}
+
+	if !(ListenerConfig{}).allowsClient(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}) {
+		t.Error("listener without allow_clients rejected a client")
+	}
+}
+
+func TestListenerAccessConfig(t *testing.T) {
+	proxies := map[string]sshProxy{
+		"env1": {Host: "env1", TargetAddrs: []string{"*.env1.internal", "db.env1"}},
+		"env2": {Host: "env2", TargetAddrs: []string{"*.env2.internal"}},
+	}
+	users := map[string]string{"alice": "a", "bob": "b"}
+
+	tests := []struct {
+		name     string
+		listener ListenerConfig
+		wantErr  bool
+	}{
+		{
+			name: "Users, groups and routes",
+			listener: ListenerConfig{
+				Users:  users,
+				Groups: map[string][]string{"dev": {"alice", "bob"}},
+				Access: map[string][]string{"@dev": {"env2"}, "alice": {"env1/db.env1"}},
+			},
+		},
+		{name: "Allowed clients", listener: ListenerConfig{AllowClients: []string{"10.0.0.0/8", "::1"}}},
+		{name: "Invalid client prefix", listener: ListenerConfig{AllowClients: []string{"10.0.0.0/40"}}, wantErr: true},
+		{name: "Client hostname", listener: ListenerConfig{AllowClients: []string{"localhost"}}, wantErr: true},
+		{name: "Access without users", listener: ListenerConfig{Access: map[string][]string{"alice": {"env1"}}}, wantErr: true},
+		{name: "Unknown group member", listener: ListenerConfig{Users: users, Groups: map[string][]string{"dev": {"carol"}}}, wantErr: true},
+		{name: "Unknown user", listener: ListenerConfig{Users: users, Access: map[string][]string{"carol": {"env1"}}}, wantErr: true},
+		{name: "Unknown group", listener: ListenerConfig{Users: users, Access: map[string][]string{"@ops": {"env1"}}}, wantErr: true},
+		{name: "Unknown proxy", listener: ListenerConfig{Users: users, Access: map[string][]string{"alice": {"env3"}}}, wantErr: true},
+		{
+			name:     "Proxy not on listener",
+			listener: ListenerConfig{Users: users, Proxies: []string{"env1"}, Access: map[string][]string{"alice": {"env2"}}},
+			wantErr:  true,
+		},
+		{name: "Unknown route", listener: ListenerConfig{Users: users, Access: map[string][]string{"alice": {"env1/*.env2.internal"}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.listener.Address, tt.listener.Port, tt.listener.Protocol = "0.0.0.0", 1080, protocolSOCKS5
+			err := tt.listener.validate(proxies)
+			if tt.wantErr && err == nil {
+				t.Errorf("validate() expected error, but got none")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("validate() unexpected error: %v", err)
+			}
+		})
+	}
+
+	socket := ListenerConfig{Socket: "/run/proxs.sock", Protocol: protocolSOCKS5, AllowClients: []string{"127.0.0.1"}}
+	if err := socket.validate(proxies); err == nil {
+		t.Error("validate() accepted allow_clients on a socket listener")
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	env1 := sshProxy{Name: "env1", TargetAddrs: []string{"*.env1.internal", "db.env1"}}
+	env2 := sshProxy{Name: "env2", TargetAddrs: []string{"*.env2.internal"}}
+	lc := ListenerConfig{
+		Users:  map[string]string{"alice": "a", "bob": "b", "carol": "c"},
+		Groups: map[string][]string{"dev": {"alice", "bob"}},
+		Access: map[string][]string{"@dev": {"env2"}, "alice": {"env1/db.env1"}},
+	}
+
+	tests := []struct {
+		name    string
+		user    string
+		proxy   sshProxy
+		rule    string
+		allowed bool
+	}{
+		{"Granted to group", "bob", env2, "*.env2.internal", true},
+		{"Granted route", "alice", env1, "db.env1", true},
+		{"Other route of granted proxy", "alice", env1, "*.env1.internal", false},
+		{"Proxy not granted", "bob", env1, "db.env1", false},
+		{"User without grants", "carol", env2, "*.env2.internal", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := lc.checkAccess(tt.user, tt.proxy, tt.rule)
+			if tt.allowed && err != nil {
+				t.Errorf("checkAccess(%q, %s, %q) = %v, expected nil", tt.user, tt.proxy.Name, tt.rule, err)
+			}
+			if !tt.allowed && !errors.Is(err, destinationDeniedError) {
+				t.Errorf("checkAccess(%q, %s, %q) = %v, expected %v", tt.user, tt.proxy.Name, tt.rule, err, destinationDeniedError)
+			}
+		})
+	}
+
+	if err := (ListenerConfig{Users: lc.Users}).checkAccess("carol", env1, "db.env1"); err != nil {
+		t.Errorf("listener without access denied a route: %v", err)
+	}
+}
+
+func TestEndToEndAccess(t *testing.T) {
+	sshtest.UseAgent(t)
+	target := sshtest.NewEchoServer(t)
+	proxyHost := sshtest.NewServer(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	addr := startProxsListener(t, sshHost("proxyhost", proxyHost, ""), `
+[proxy.env1]
+host = "proxyhost"
+target_addrs = ["127.0.0.1", "localhost"]
+`, ListenerConfig{
+		Address:      "127.0.0.1",
+		Protocol:     protocolSOCKS5,
+		Users:        map[string]string{"alice": "a", "bob": "b"},
+		AllowClients: []string{"127.0.0.0/8"},
+		Access:       map[string][]string{"alice": {"env1/127.0.0.1"}},
+	})
+
+	dial := func(user, password, dest string) (net.Conn, error) {
+		dialer, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: user, Password: password}, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", dest)
+	}
+
+	conn, err := dial("alice", "a", target)
+	if err != nil {
+		t.Fatalf("granted route: %v", err)
+	}
+	if got := echo(t, conn, "hello"); got != "hello" {
+		t.Errorf("echoed %q, expected %q", got, "hello")
+	}
+	conn.Close()
+
+	for _, tt := range []struct{ user, password, dest string }{
+		{"alice", "a", net.JoinHostPort("localhost", port)},
+		{"bob", "b", target},
+	} {
+		if _, err := dial(tt.user, tt.password, tt.dest); err == nil || !strings.Contains(err.Error(), "connection not allowed by ruleset") {
+			t.Errorf("%s dialing %s: error = %v, expected connection not allowed", tt.user, tt.dest, err)
+		}
+	}
+	if forwarded := proxyHost.Forwarded(); len(forwarded) != 1 {
+		t.Errorf("proxy host opened channels to %v, expected only the granted route", forwarded)
+	}
+
+	denied := startProxsListener(t, sshHost("proxyhost", proxyHost, ""), `
+[proxy.env1]
+host = "proxyhost"
+target_addrs = ["127.0.0.1"]
+`, ListenerConfig{Address: "127.0.0.1", Protocol: protocolSOCKS5, AllowClients: []string{"192.0.2.0/24"}})
+	if _, err := socksDial(t, denied, target); err == nil {
+		t.Error("client outside allow_clients was served")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const (
+	balanceLeastStreams = "least_streams"
+	balanceRoundRobin   = "round_robin"
+
+	// growRetryAfter is how long the pool waits before dialing an extra
+	// chain again after one failed; the chains it has keep serving.
+	growRetryAfter = 30 * time.Second
+)
+
+// pick returns the active client to open the next stream on, or nil when
+// every active client is at maxPerClient. p.mu must be held.
+func (p *sshPool) pick() *poolClient {
+	if p.balance == balanceRoundRobin {
+		for range p.active {
+			p.next = (p.next + 1) % len(p.active)
+			if pc := p.active[p.next]; p.hasRoom(pc) {
+				return pc
+			}
+		}
+		return nil
+	}
+
+	var best *poolClient
+	for _, pc := range p.active {
+		if p.hasRoom(pc) && (best == nil || pc.streams < best.streams) {
+			best = pc
+		}
+	}
+	return best
+}
+
+// hasRoom reports whether another stream may be opened on pc. p.mu must
+// be held.
+func (p *sshPool) hasRoom(pc *poolClient) bool {
+	return p.maxPerClient == 0 || pc.streams < p.maxPerClient
+}
+
+// full reports whether every active client is at maxPerClient. p.mu must
+// be held.
+func (p *sshPool) full() bool {
+	return len(p.active) > 0 && !slices.ContainsFunc(p.active, p.hasRoom)
+}
+
+// grow dials one more chain in the background when the pool holds fewer
+// than its size, or when every client it holds is full. p.mu must be held.
+func (p *sshPool) grow() {
+	if p.closed || p.growing || (len(p.active) >= p.size && !p.full()) || time.Since(p.growFailedAt) < growRetryAfter {
+		return
+	}
+	p.growing = true
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), reconnectTimeout)
+		pc, err := p.dialGroup(ctx, nil)
+		cancel()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.growing = false
+		if err != nil {
+			// The proxy keeps working with the chains it has, so this does
+			// not count against its health.
+			p.growFailedAt = time.Now()
+			slog.Warn("Failed to open an additional SSH connection", "proxy", p.name, "connections", len(p.active), "error", err)
+			return
+		}
+		if p.closed || (len(p.active) >= p.size && !p.full()) {
+			pc.cleanup()
+			return
+		}
+		p.adopt(pc)
+		p.activate(pc, nil)
+		slog.Debug("Opened an additional SSH connection", "proxy", p.name, "connections", len(p.active))
+		p.grow()
+	}()
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestPoolPick(t *testing.T) {
+	a, b, c := &poolClient{streams: 2}, &poolClient{streams: 0}, &poolClient{streams: 1}
+
+	tests := []struct {
+		balance  string
+		expected []*poolClient
+	}{
+		{balanceLeastStreams, []*poolClient{b, b, b, c}},
+		{balanceRoundRobin, []*poolClient{b, c, a, b}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.balance, func(t *testing.T) {
+			a.streams, b.streams, c.streams = 2, 0, 1
+			p := &sshPool{balance: tt.balance, active: []*poolClient{a, b, c}}
+			for i, expected := range tt.expected {
+				pc := p.pick()
+				if pc != expected {
+					t.Errorf("pick() #%d returned client with %d streams, expected the one with %d", i+1, pc.streams, expected.streams)
+				}
+				// Every second pick opens a stream, as a request would.
+				if i%2 == 0 {
+					pc.streams++
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigPoolSize(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[proxy.bulk]
+host = "env2"
+target_addrs = ["*.bulk.internal"]
+connections = 4
+balance = "round_robin"
+`)
+	cfg, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := cfg.Proxies["bulk"].pool
+	if p.size != 4 || p.balance != balanceRoundRobin {
+		t.Errorf("pool size %d balance %q, expected 4 and %q", p.size, p.balance, balanceRoundRobin)
+	}
+	if p := cfg.Proxies["env1"].pool; p.size != 1 || p.balance != balanceLeastStreams {
+		t.Errorf("default pool size %d balance %q, expected 1 and %q", p.size, p.balance, balanceLeastStreams)
+	}
+
+	bad := writeTestConfig(t, `
+[proxy.bulk]
+host = "env2"
+target_addrs = ["*.bulk.internal"]
+balance = "random"
+`)
+	if _, err := LoadConfigFile(bad); err == nil {
+		t.Error("expected an unknown balance to be rejected")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bean1310/proxs/internal/sshtest"
+	"golang.org/x/net/proxy"
+)
+
+// BenchmarkPaths downloads payloads of several sizes from a local target,
+// with several clients at once, directly, through proxs and through the
+// dynamic forwarding of OpenSSH (`ssh -D`), both to the same in-process SSH
+// server. Besides throughput, it reports the mean connection setup latency
+// (until the connection, or the SOCKS5 CONNECT, succeeded) and time to first
+// byte of each connection. To compare the paths side by side:
+//
+//	go test -run '^$' -bench Paths -count 6 | tee bench.txt
+//	benchstat -col /path bench.txt
+func BenchmarkPaths(b *testing.B) {
+	target := newPayloadServer(b)
+	paths := []struct {
+		name   string
+		dialer func(b *testing.B) proxy.ContextDialer
+	}{
+		{"direct", func(*testing.B) proxy.ContextDialer { return &net.Dialer{} }},
+		{"proxs", proxsDialer},
+		{"ssh-D", sshDynamicDialer},
+	}
+
+	for _, size := range []int{10 << 10, 1 << 20, 16 << 20} {
+		for _, clients := range []int{1, 8} {
+			for _, path := range paths {
+				b.Run(fmt.Sprintf("size=%dKiB/clients=%d/path=%s", size>>10, clients, path.name), func(b *testing.B) {
+					benchmarkPath(b, path.dialer(b), target, size, clients)
+				})
+			}
+		}
+	}
+}
+
+// benchmarkPath runs b.N rounds in which each of clients connects to
+// target through dialer and downloads size bytes.
+func benchmarkPath(b *testing.B, dialer proxy.ContextDialer, target string, size, clients int) {
+	ctx := context.Background()
+
+	// Warm up, so that SSH connections are established before measuring.
+	if _, _, err := download(ctx, dialer, target, size); err != nil {
+		b.Fatal(err)
+	}
+
+	var setup, ttfb atomic.Int64
+	b.SetBytes(int64(size * clients))
+	b.ResetTimer()
+	for range b.N {
+		var wg sync.WaitGroup
+		errs := make(chan error, clients)
+		for range clients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s, f, err := download(ctx, dialer, target, size)
+				if err != nil {
+					errs <- err
+					return
+				}
+				setup.Add(int64(s))
+				ttfb.Add(int64(f))
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		if err := <-errs; err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	conns := float64(b.N * clients)
+	b.ReportMetric(float64(setup.Load())/conns/float64(time.Millisecond), "setup-ms")
+	b.ReportMetric(float64(ttfb.Load())/conns/float64(time.Millisecond), "ttfb-ms")
+}
+
+// download connects to target through dialer, asks for size bytes and
+// reads them. It returns the time taken to connect and to receive the
+// first byte.
+func download(ctx context.Context, dialer proxy.ContextDialer, target string, size int) (setup, ttfb time.Duration, err error) {
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	setup = time.Since(start)
+
+	if err := binary.Write(conn, binary.BigEndian, uint64(size)); err != nil {
+		return 0, 0, err
+	}
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return 0, 0, err
+	}
+	ttfb = time.Since(start)
+
+	n, err := io.Copy(io.Discard, conn)
+	if err == nil && n != int64(size-1) {
+		err = fmt.Errorf("received %d bytes, expected %d", n+1, size)
+	}
+	return setup, ttfb, err
+}
+
+// newPayloadServer starts a TCP server that reads a big-endian uint64 from
+// each connection, writes that many bytes and closes it, and returns its
+// address.
+func newPayloadServer(b *testing.B) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+
+	payload := make([]byte, 64<<10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var size uint64
+				if err := binary.Read(c, binary.BigEndian, &size); err != nil {
+					return
+				}
+				for size > 0 {
+					n := min(size, uint64(len(payload)))
+					if _, err := c.Write(payload[:n]); err != nil {
+						return
+					}
+					size -= n
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// proxsDialer returns a SOCKS5 dialer through proxs, routing to an
+// in-process SSH server.
+func proxsDialer(b *testing.B) proxy.ContextDialer {
+	// Keep the log out of the benchmark results.
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	b.Cleanup(func() { slog.SetDefault(logger) })
+
+	sshtest.UseAgent(b)
+	proxyHost := sshtest.NewServer(b)
+	addr := startProxs(b, sshHost("proxyhost", proxyHost, ""), `
+[proxy.bench]
+host = "proxyhost"
+target_addrs = ["127.0.0.1"]
+`)
+	return socks5Dialer(b, addr)
+}
+
+// sshDynamicDialer returns a SOCKS5 dialer through `ssh -D`, connected to
+// an in-process SSH server. It skips the benchmark when ssh is not
+// installed.
+func sshDynamicDialer(b *testing.B) proxy.ContextDialer {
+	path, err := exec.LookPath("ssh")
+	if err != nil {
+		b.Skip("ssh is not installed")
+	}
+	proxyHost := sshtest.NewServer(b)
+
+	// Reserve a port for ssh to listen on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cmd := exec.Command(path, "-N", "-F", "/dev/null",
+		"-D", addr,
+		"-p", strconv.Itoa(proxyHost.Port()),
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "BatchMode=yes",
+		"-o", "LogLevel=ERROR",
+		"test@127.0.0.1")
+	if err := cmd.Start(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			b.Fatalf("ssh -D did not listen on %s: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return socks5Dialer(b, addr)
+}
+
+func socks5Dialer(b *testing.B, addr string) proxy.ContextDialer {
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return dialer.(proxy.ContextDialer)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// buildVersion is set at build time with -ldflags "-X main.buildVersion=...".
+var buildVersion string
+
+// version returns the version of the binary, falling back to the module
+// version or VCS revision recorded by the Go toolchain.
+func version() string {
+	if buildVersion != "" {
+		return buildVersion
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			return "devel-" + s.Value[:12]
+		}
+	}
+	return "devel"
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string, stdout io.Writer) error
+}
+
+var commands = []command{
+	{"run", "", "Serve proxy clients (the default when no command is given)", cmdRun},
+	{"check", "", "Validate the configuration and resolve every proxy's SSH chain", cmdCheck},
+	{"route", "HOST[:PORT]", "Print the proxy and hops a destination would be routed through", cmdRoute},
+	{"status", "", "Query a running proxs daemon", cmdStatus},
+	{"version", "", "Print the version", cmdVersion},
+}
+
+// runCommand dispatches the command line to a subcommand and returns the
+// process exit code.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage(stdout)
+		return 0
+	}
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		if err := cmd.run(args, stdout); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 0
+			}
+			fmt.Fprintf(stderr, "proxs %s: %v\n", name, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "proxs: unknown command %q\n\n", name)
+	usage(stderr)
+	return 2
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: proxs <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'proxs <command> -h' for the flags of a command.")
+}
+
+// commonFlags are the flags shared by every command that reads the
+// configuration.
+type commonFlags struct {
+	configPath string
+	logLevel   string
+}
+
+func newFlagSet(name, args string, stdout io.Writer, cf *commonFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	fs.Usage = func() {
+		fmt.Fprintf(stdout, "Usage: proxs %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	if cf != nil {
+		fs.StringVar(&cf.configPath, "config", "", "path of config.toml (default: user configuration directory)")
+		fs.StringVar(&cf.logLevel, "log-level", "", "minimum level of log records: debug, info, warn or error")
+	}
+	return fs
+}
+
+// apply sets the log level and resolves the default configuration path.
+// Commands other than run only log warnings unless asked otherwise, so that
+// their output is not buried under the daemon's informational records.
+func (cf *commonFlags) apply(defaultLevel slog.Level) error {
+	level := defaultLevel
+	if cf.logLevel != "" {
+		var err error
+		if level, err = parseLogLevel(cf.logLevel); err != nil {
+			return err
+		}
+	}
+	slog.SetLogLoggerLevel(level)
+
+	if cf.configPath == "" {
+		path, err := defaultConfigPath()
+		if err != nil {
+			return err
+		}
+		cf.configPath = path
+	}
+	return nil
+}
+
+// stringsFlag is a flag that can be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string     { return strings.Join(*f, ",") }
+func (f *stringsFlag) Set(v string) error { *f = append(*f, v); return nil }
+
+func cmdRun(args []string, stdout io.Writer) error {
+	var cf commonFlags
+	var listen stringsFlag
+	fs := newFlagSet("run", "", stdout, &cf)
+	fs.Var(&listen, "listen", "SOCKS5 listen address HOST:PORT or Unix socket path, replacing the configured listeners (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if err := cf.apply(slog.LevelInfo); err != nil {
+		return err
+	}
+
+	return run(runOptions{ConfigPath: cf.configPath, Listen: listen, LogLevel: cf.logLevel})
+}
+
+func cmdCheck(args []string, stdout io.Writer) error {
+	var cf commonFlags
+	fs := newFlagSet("check", "", stdout, &cf)
+	dial := fs.Bool("dial", false, "also connect to every proxy through its SSH chain")
+	timeout := fs.Duration("timeout", 30*time.Second, "time limit for each proxy when -dial is set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := cf.apply(slog.LevelWarn); err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfigFile(cf.configPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s: OK\n", cf.configPath)
+
+	failed := 0
+	for _, proxy := range cfg.proxiesFor(ListenerConfig{}) {
+		reached := 0
+		for i, conn := range proxy.Connections {
+			if i == 0 {
+				fmt.Fprintf(stdout, "proxy %s: %s\n", proxy.Name, formatChain(conn))
+			} else {
+				fmt.Fprintf(stdout, "  alternate: %s\n", formatChain(conn))
+			}
+			if !*dial {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			start := time.Now()
+			client, cleanup, err := conn.Dial(ctx, "tcp", "")
+			cancel()
+			if err != nil {
+				fmt.Fprintf(stdout, "  dial: FAILED: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(stdout, "  dial: OK in %s (server %s)\n", time.Since(start).Round(time.Millisecond), client.ServerVersion())
+			cleanup()
+			reached++
+		}
+		// A failover group is usable as long as one of its hosts is.
+		if *dial && reached == 0 {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d proxies could not be reached", failed, len(cfg.Proxies))
+	}
+	return nil
+}
+
+func cmdRoute(args []string, stdout io.Writer) error {
+	var cf commonFlags
+	fs := newFlagSet("route", "HOST[:PORT]", stdout, &cf)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one destination")
+	}
+	if err := cf.apply(slog.LevelWarn); err != nil {
+		return err
+	}
+
+	host, port, err := parseDestination(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfigFile(cf.configPath)
+	if err != nil {
+		return err
+	}
+	proxy, err := sshProxySelectFrom(context.Background(), host, cfg.proxiesFor(ListenerConfig{}))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "proxy %s (host %s)\n", proxy.Name, strings.Join(proxy.hosts(), ", "))
+	for i, hop := range proxy.Connection.Chain() {
+		fmt.Fprintf(stdout, "  %d. %s\n", i+1, hop)
+	}
+	for _, conn := range proxy.Connections[1:] {
+		fmt.Fprintf(stdout, "  or: %s\n", formatChain(conn))
+	}
+	dest := host
+	if port != 0 {
+		dest = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	fmt.Fprintf(stdout, "  -> %s\n", dest)
+	return cfg.checkDestination(proxy, host, port)
+}
+
+// parseDestination splits HOST[:PORT]. A missing port is returned as 0.
+func parseDestination(dest string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		// No port, possibly a bare IPv6 address.
+		return strings.Trim(dest, "[]"), 0, nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %q", dest)
+	}
+	return host, uint16(port), nil
+}
+
+func cmdStatus(args []string, stdout io.Writer) error {
+	var cf commonFlags
+	fs := newFlagSet("status", "", stdout, &cf)
+	socket := fs.String("admin", "", "admin socket of the daemon (default: [admin] from the configuration)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := cf.apply(slog.LevelWarn); err != nil {
+		return err
+	}
+
+	ac := AdminConfig{Socket: *socket}
+	if !ac.enabled() {
+		cfg, err := LoadConfigFile(cf.configPath)
+		if err != nil {
+			return err
+		}
+		ac = cfg.Admin
+	}
+
+	st, err := fetchStatus(ac)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "proxs %s, pid %d, up %s\n", st.Version, st.PID, time.Since(st.StartedAt).Round(time.Second))
+	for _, ln := range st.Listeners {
+		fmt.Fprintf(stdout, "listening on %s %s (%s)\n", ln.Network, ln.Address, ln.Protocol)
+	}
+	fmt.Fprintf(stdout, "active connections: %d\n\n", st.Connections)
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROXY\tHEALTH\tSTATE\tSTREAMS\tCHAIN")
+	for _, ps := range st.Proxies {
+		state := "idle"
+		switch {
+		case ps.Closed:
+			state = "draining"
+		case ps.Connections > 1:
+			state = fmt.Sprintf("connected x%d", ps.Connections)
+		case ps.Connected:
+			state = "connected"
+		}
+		health := ps.Health
+		if ps.NextRetry != nil {
+			health += fmt.Sprintf(" (retry in %s)", max(time.Until(*ps.NextRetry), 0).Round(time.Second))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", ps.Name, health, state, ps.Streams, strings.Join(ps.Chain, " -> "))
+	}
+	return tw.Flush()
+}
+
+func cmdVersion(args []string, stdout io.Writer) error {
+	fs := newFlagSet("version", "", stdout, nil)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "proxs %s\n", version())
+	return nil
+}
+
+func formatChain(sc *sshConnection) string {
+	return strings.Join(chainStrings(sc), " -> ")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes an ssh_config and a config.toml for two proxies,
+// one of them behind a jump host, and returns the path of config.toml.
+func writeTestConfig(t *testing.T, extra string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	sshConfig := filepath.Join(dir, "ssh_config")
+	writeTestFile(t, sshConfig, `
+Host bastion
+    HostName bastion.example.com
+    User jump
+Host env1
+    HostName env1.internal
+    User ubuntu
+    Port 2222
+    ProxyJump bastion
+Host env2
+    HostName env2.example.com
+    User admin
+`)
+	t.Setenv("SSH_CONFIG_FILE", sshConfig)
+
+	configPath := filepath.Join(dir, "config.toml")
+	writeTestFile(t, configPath, `
+port = 8080
+`+extra+`
+[proxy.env1]
+host = "env1"
+target_addrs = ["*.env1.internal"]
+
+[proxy.env2]
+host = "env2"
+target_addrs = ["*.env2.internal", "10.0.0.*"]
+`)
+	return configPath
+}
+
+func TestCommandRoute(t *testing.T) {
+	configPath := writeTestConfig(t, "")
+
+	var stdout, stderr bytes.Buffer
+	code := runCommand([]string{"route", "--config", configPath, "db.env1.internal:5432"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("route exited with %d: %s", code, stderr.String())
+	}
+
+	expected := `proxy env1 (host env1)
+  1. jump@bastion.example.com:22
+  2. ubuntu@env1.internal:2222
+  -> db.env1.internal:5432
+`
+	if stdout.String() != expected {
+		t.Errorf("route output = %q, expected %q", stdout.String(), expected)
+	}
+
+	stdout.Reset()
+	if code := runCommand([]string{"route", "--config", configPath, "example.com"}, &stdout, &stderr); code != 1 {
+		t.Errorf("route for an unrouted destination exited with %d, expected 1", code)
+	}
+
+	configPath = writeTestConfig(t, "[acl]\ndeny_ports = [5432]\n")
+	stderr.Reset()
+	if code := runCommand([]string{"route", "--config", configPath, "db.env1.internal:5432"}, &stdout, &stderr); code != 1 {
+		t.Errorf("route for a denied destination exited with %d, expected 1", code)
+	}
+	if !strings.Contains(stderr.String(), "destination denied by deny_ports 5432") {
+		t.Errorf("route stderr = %q, expected the denying rule", stderr.String())
+	}
+}
+
+func TestCommandCheck(t *testing.T) {
+	configPath := writeTestConfig(t, "")
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"check", "--config", configPath}, &stdout, &stderr); code != 0 {
+		t.Fatalf("check exited with %d: %s", code, stderr.String())
+	}
+	for _, want := range []string{
+		configPath + ": OK",
+		"proxy env1: jump@bastion.example.com:22 -> ubuntu@env1.internal:2222",
+		"proxy env2: admin@env2.example.com:22",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("check output %q does not contain %q", stdout.String(), want)
+		}
+	}
+
+	badConfig := filepath.Join(t.TempDir(), "config.toml")
+	writeTestFile(t, badConfig, "[[listener]]\nprotocol = \"socks6\"\nport = 1080\n")
+	stderr.Reset()
+	if code := runCommand([]string{"check", "--config", badConfig}, &stdout, &stderr); code != 1 {
+		t.Errorf("check of an invalid config exited with %d, expected 1", code)
+	}
+}
+
+func TestCommandStatus(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	configPath := writeTestConfig(t, "[admin]\nsocket = \""+socket+"\"\n")
+
+	cfg, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg, nil)
+	if err := srv.ServeAdmin(cfg.Admin); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(0)
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"status", "--config", configPath}, &stdout, &stderr); code != 0 {
+		t.Fatalf("status exited with %d: %s", code, stderr.String())
+	}
+	for _, want := range []string{"active connections: 0", "env1", "up", "idle", "ubuntu@env1.internal:2222"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("status output %q does not contain %q", stdout.String(), want)
+		}
+	}
+}
+
+func TestCommandUnknown(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"frobnicate"}, &stdout, &stderr); code != 2 {
+		t.Errorf("unknown command exited with %d, expected 2", code)
+	}
+	if code := runCommand([]string{"version"}, &stdout, &stderr); code != 0 || !strings.HasPrefix(stdout.String(), "proxs ") {
+		t.Errorf("version exited with %d and printed %q", code, stdout.String())
+	}
+}
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{"127.0.0.1:1080", "127.0.0.1:1080", false},
+		{":1080", "127.0.0.1:1080", false},
+		{"[::1]:1080", "[::1]:1080", false},
+		{"/run/proxs.sock", "/run/proxs.sock", false},
+		{"1080", "", true},
+	}
+
+	for _, tt := range tests {
+		lc, err := parseListenAddr(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseListenAddr(%q) expected error, but got none", tt.input)
+			}
+			continue
+		}
+		if err != nil || lc.Addr() != tt.expected {
+			t.Errorf("parseListenAddr(%q) = %s, %v, expected %s", tt.input, lc.Addr(), err, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// defaultQueueTimeout is how long a request waits for a stream when a
+	// proxy is at its stream limits, or a client for a slot when the
+	// server is at max_clients.
+	defaultQueueTimeout = 10 * time.Second
+
+	// defaultAcceptQueue is how many clients may wait for a slot when
+	// max_clients is set.
+	defaultAcceptQueue = 64
+)
+
+var streamLimitError = errors.New("stream limit reached")
+var clientLimitError = errors.New("client limit reached")
+
+// acquireSlot takes a token for a new stream when the number of streams of
+// the proxy is capped, waiting for a stream to end until queue fires.
+func (p *sshPool) acquireSlot(ctx context.Context, queue <-chan time.Time) error {
+	if p.slots == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	slog.DebugContext(ctx, "Waiting for a stream slot", "proxy", p.name, "max_streams", cap(p.slots))
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-queue:
+		return fmt.Errorf("%w: proxy %s has %d streams open", streamLimitError, p.name, cap(p.slots))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseSlot returns the token taken by acquireSlot.
+func (p *sshPool) releaseSlot() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// reserve returns an active client with room for another stream and counts
+// the stream on it, dialing a chain if there is none. While every client
+// is at max_streams_per_connection, another chain is dialed and the
+// request waits for it, or for a stream to end, until queue fires.
+func (p *sshPool) reserve(ctx context.Context, queue <-chan time.Time) (*poolClient, error) {
+	for {
+		if _, err := p.get(ctx); err != nil {
+			return nil, err
+		}
+
+		p.mu.Lock()
+		if pc := p.pick(); pc != nil {
+			p.countStream(pc)
+			p.mu.Unlock()
+			return pc, nil
+		}
+		full := len(p.active) > 0
+		if full {
+			p.grow()
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		if !full {
+			// The clients were lost since get returned; dial again.
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-queue:
+			return nil, fmt.Errorf("%w: every SSH connection of proxy %s has %d streams open", streamLimitError, p.name, p.maxPerClient)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// admission caps the number of clients handled at once. Clients accepted
+// beyond the cap wait for a slot in a bounded queue, and are disconnected
+// when the queue is full or their wait times out.
+type admission struct {
+	slots   chan struct{} // a token per client being handled
+	entered chan struct{} // a token per client being handled or queued
+	timeout time.Duration
+}
+
+// newAdmission returns the admission control of lc, or nil when the number
+// of clients is not capped.
+func newAdmission(lc LimitsConfig) *admission {
+	if lc.MaxClients == 0 {
+		return nil
+	}
+	queue := defaultAcceptQueue
+	if lc.AcceptQueue != nil {
+		queue = *lc.AcceptQueue
+	}
+	return &admission{
+		slots:   make(chan struct{}, lc.MaxClients),
+		entered: make(chan struct{}, lc.MaxClients+queue),
+		timeout: cmp.Or(lc.AcceptQueueTimeout, defaultQueueTimeout),
+	}
+}
+
+// enter reserves a place for a new client, either a slot or a place in the
+// queue. It reports false, without blocking, when the queue is full.
+func (a *admission) enter() bool {
+	if a == nil {
+		return true
+	}
+	select {
+	case a.entered <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for a slot for a client that entered. The returned function
+// frees the slot once the client is handled.
+func (a *admission) wait(ctx context.Context) (release func(), err error) {
+	if a == nil {
+		return func() {}, nil
+	}
+	leave := func() { <-a.entered }
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return func() {
+			<-a.slots
+			leave()
+		}, nil
+	case <-timer.C:
+		leave()
+		return nil, fmt.Errorf("%w: no client slot free after %s", clientLimitError, a.timeout)
+	case <-ctx.Done():
+		leave()
+		return nil, ctx.Err()
+	}
+}
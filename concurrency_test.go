@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bean1310/proxs/internal/sshtest"
+)
+
+func TestAdmission(t *testing.T) {
+	queue := 1
+	a := newAdmission(LimitsConfig{MaxClients: 1, AcceptQueue: &queue, AcceptQueueTimeout: 50 * time.Millisecond})
+
+	if !a.enter() || !a.enter() {
+		t.Fatal("enter() rejected a client with a slot or queue place free")
+	}
+	if a.enter() {
+		t.Fatal("enter() accepted a client with the queue full")
+	}
+
+	release, err := a.wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.wait(context.Background()); !errors.Is(err, clientLimitError) {
+		t.Errorf("wait() error = %v, expected %v", err, clientLimitError)
+	}
+
+	// The timed-out client left the queue and the first one its slot.
+	release()
+	if !a.enter() {
+		t.Fatal("enter() rejected a client after the others left")
+	}
+	release, err = a.wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	if newAdmission(LimitsConfig{}) != nil {
+		t.Error("expected no admission control without max_clients")
+	}
+	var none *admission
+	if !none.enter() {
+		t.Error("enter() without max_clients should always succeed")
+	}
+}
+
+func TestPoolMaxStreams(t *testing.T) {
+	sshtest.UseAgent(t)
+	proxyHost := sshtest.NewServer(t)
+	target := sshtest.NewSinkServer(t)
+
+	pool := newProxyPool(sshProxy{Name: "env1", Connections: []*sshConnection{sshConn(proxyHost, nil)}, MaxStreams: 1, QueueTimeout: 50 * time.Millisecond})
+	defer pool.Close()
+
+	first, err := pool.Dial(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Dial(context.Background(), "tcp", target); !errors.Is(err, streamLimitError) {
+		t.Fatalf("Dial() beyond max_streams error = %v, expected %v", err, streamLimitError)
+	}
+
+	// A queued request gets the slot of a stream that ends.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		first.Close()
+	}()
+	second, err := pool.Dial(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatalf("queued Dial() failed: %v", err)
+	}
+	second.Close()
+}
+
+func TestPoolMaxStreamsPerConnection(t *testing.T) {
+	sshtest.UseAgent(t)
+	proxyHost := sshtest.NewServer(t)
+	target := sshtest.NewSinkServer(t)
+
+	pool := newProxyPool(sshProxy{Name: "env1", Connections: []*sshConnection{sshConn(proxyHost, nil)}, MaxStreamsPerConnection: 2})
+	defer pool.Close()
+
+	// The third stream spills over to a new SSH connection.
+	var conns []net.Conn
+	for range 3 {
+		conn, err := pool.Dial(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	if n := proxyHost.Conns(); n != 2 {
+		t.Errorf("proxy host accepted %d SSH connections, expected 2", n)
+	}
+	pool.mu.Lock()
+	for _, pc := range pool.active {
+		if pc.streams > 2 {
+			t.Errorf("SSH connection has %d streams, expected at most 2", pc.streams)
+		}
+	}
+	pool.mu.Unlock()
+
+	// Once idle, the additional connection is closed.
+	for _, conn := range conns {
+		conn.Close()
+	}
+	waitFor(t, "the additional SSH connection to close", func() bool { return proxyHost.Open() == 1 })
+	if st := pool.stats(); st.Connections != 1 || st.Streams != 0 {
+		t.Errorf("pool has %d connections and %d streams, expected 1 and 0", st.Connections, st.Streams)
+	}
+}
@@ -1,32 +1,154 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/kevinburke/ssh_config"
 )
 
 type Config struct {
-	ListenPort int                 `toml:"port"`
-	Proxies    map[string]sshProxy `toml:"proxy"`
+	ListenPort      int                 `toml:"port"`
+	ShutdownTimeout time.Duration       `toml:"shutdown_timeout"`
+	Listeners       []ListenerConfig    `toml:"listener"`
+	Admin           AdminConfig         `toml:"admin"`
+	Metrics         MetricsConfig       `toml:"metrics"`
+	Log             LogConfig           `toml:"log"`
+	AccessLog       AccessLogConfig     `toml:"access_log"`
+	Timeouts        TimeoutConfig       `toml:"timeouts"`
+	Relay           RelayConfig         `toml:"relay"`
+	Limits          LimitsConfig        `toml:"limits"`
+	ACL             ACL                 `toml:"acl"`
+	Proxies         map[string]sshProxy `toml:"proxy"`
+
+	clientLimits *clientLimits
+
+	// holds counts the connections accepted with this configuration that
+	// are still running, and retire drains what the configuration replacing
+	// it no longer uses once holds drops to zero. Both are guarded by the
+	// cfgMu of the server.
+	holds  int
+	retire func()
 }
 
-func makeNestedSshConnection(host string) (*sshConnection, error) {
+// listeners returns the configured listeners. A config without [[listener]]
+// tables keeps the historical behaviour of a SOCKS5 listener on
+// 127.0.0.1:port, and TCP listeners without an address listen on
+// 127.0.0.1 too, so that a proxy is only exposed beyond loopback on purpose.
+func (c *Config) listeners() []ListenerConfig {
+	if len(c.Listeners) == 0 {
+		return []ListenerConfig{{Address: "127.0.0.1", Port: c.ListenPort, Protocol: protocolSOCKS5}}
+	}
+	listeners := make([]ListenerConfig, len(c.Listeners))
+	for i, lc := range c.Listeners {
+		if lc.Protocol == "" {
+			lc.Protocol = protocolSOCKS5
+		}
+		if lc.Socket == "" && lc.Address == "" {
+			lc.Address = "127.0.0.1"
+		}
+		listeners[i] = lc
+	}
+	return listeners
+}
 
-	result := &sshConnection{}
-	var err error
+// proxiesFor returns the proxies a listener may route through, ordered by
+// name so that overlapping target_addrs resolve deterministically.
+func (c *Config) proxiesFor(lc ListenerConfig) []sshProxy {
+	names := lc.Proxies
+	if len(names) == 0 {
+		names = slices.Collect(maps.Keys(c.Proxies))
+	}
+	names = slices.Sorted(slices.Values(names))
+
+	proxies := make([]sshProxy, 0, len(names))
+	for _, name := range names {
+		// A listener kept across a reload may name a proxy that is gone.
+		if proxy, ok := c.Proxies[name]; ok {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// listenerFor returns the current settings of an open listener, or lc
+// itself when the listener is no longer configured. Listeners are matched
+// by name and address, which cannot change without reopening the socket.
+func (c *Config) listenerFor(lc ListenerConfig) ListenerConfig {
+	for _, l := range c.listeners() {
+		if l.key() == lc.key() {
+			return l
+		}
+	}
+	return lc
+}
+
+// pools returns the SSH pool of every proxy, ordered by proxy name.
+func (c *Config) pools() []*sshPool {
+	pools := make([]*sshPool, 0, len(c.Proxies))
+	for _, name := range slices.Sorted(maps.Keys(c.Proxies)) {
+		pools = append(pools, c.Proxies[name].pool)
+	}
+	return pools
+}
+
+// sshConfigFiles returns path and the files it includes, recursively. As
+// in ssh_config.Decode, relative Include patterns are relative to ~/.ssh.
+func sshConfigFiles(path string) []string {
+	files := []string{path}
+	seen := map[string]bool{path: true}
+	for i := 0; i < len(files); i++ {
+		data, err := os.ReadFile(files[i])
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			fields := strings.Fields(strings.Replace(line, "=", " ", 1))
+			if len(fields) < 2 || !strings.EqualFold(fields[0], "Include") {
+				continue
+			}
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					home, _ := os.UserHomeDir()
+					pattern = filepath.Join(home, ".ssh", pattern)
+				}
+				matches, _ := filepath.Glob(pattern)
+				for _, match := range matches {
+					if !seen[match] {
+						seen[match] = true
+						files = append(files, match)
+					}
+				}
+			}
+		}
+	}
+	return files
+}
 
+// sshConfigPath returns the ssh_config file that SSH hosts are resolved from.
+func sshConfigPath() string {
 	// If `SSH_CONFIG_FILE` is set, use it; otherwise, use the default location.
-	configPath := os.Getenv("SSH_CONFIG_FILE")
-	if configPath == "" {
-		configPath = filepath.Join(os.Getenv("HOME"), ".ssh", "config")
+	if configPath := os.Getenv("SSH_CONFIG_FILE"); configPath != "" {
+		return configPath
 	}
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "config")
+}
 
-	f, err := os.Open(configPath)
+func makeNestedSshConnection(host string) (*sshConnection, error) {
+
+	result := &sshConnection{}
+	var err error
+
+	f, err := os.Open(sshConfigPath())
 	if err != nil {
 		return nil, err
 	}
@@ -71,6 +193,24 @@ func makeNestedSshConnection(host string) (*sshConnection, error) {
 		return nil, err
 	}
 
+	result.ServerAliveInterval, result.ServerAliveCountMax, err = serverAliveSettings(cfg, host)
+	if err != nil {
+		slog.Error("Invalid keepalive settings in ssh config", "host", host, "error", err)
+		return nil, err
+	}
+
+	result.ConnectTimeout, err = connectTimeout(cfg, host)
+	if err != nil {
+		slog.Error("Invalid ConnectTimeout in ssh config", "host", host, "error", err)
+		return nil, err
+	}
+
+	result.Ciphers, err = ciphers(cfg, host)
+	if err != nil {
+		slog.Error("Failed to get Ciphers from ssh config", "host", host, "error", err)
+		return nil, err
+	}
+
 	result.User, err = cfg.Get(host, "User")
 	if err != nil {
 		slog.Error("Failed to get User from ssh config", "host", host, "error", err)
@@ -84,33 +224,170 @@ func makeNestedSshConnection(host string) (*sshConnection, error) {
 	return result, nil
 }
 
-func LoadConfig() (*Config, error) {
-	config := &Config{}
+// serverAliveSettings returns the ServerAliveInterval and
+// ServerAliveCountMax of host. As in OpenSSH, an interval of zero disables
+// keepalives and the count defaults to 3.
+func serverAliveSettings(cfg *ssh_config.Config, host string) (time.Duration, int, error) {
+	intervalStr, err := cfg.Get(host, "ServerAliveInterval")
+	if err != nil {
+		return 0, 0, err
+	}
+	countStr, err := cfg.Get(host, "ServerAliveCountMax")
+	if err != nil {
+		return 0, 0, err
+	}
 
-	configDir, err := configDir("proxs")
+	var interval, count int
+	if intervalStr != "" {
+		if interval, err = strconv.Atoi(intervalStr); err != nil || interval < 0 {
+			return 0, 0, fmt.Errorf("invalid ServerAliveInterval %q", intervalStr)
+		}
+	}
+	count = 3
+	if countStr != "" {
+		if count, err = strconv.Atoi(countStr); err != nil || count < 0 {
+			return 0, 0, fmt.Errorf("invalid ServerAliveCountMax %q", countStr)
+		}
+	}
+	return time.Duration(interval) * time.Second, count, nil
+}
+
+// connectTimeout returns the ConnectTimeout of host, or zero when it is not
+// set.
+func connectTimeout(cfg *ssh_config.Config, host string) (time.Duration, error) {
+	s, err := cfg.Get(host, "ConnectTimeout")
+	if err != nil || s == "" {
+		return 0, err
+	}
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid ConnectTimeout %q", s)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// ciphers returns the Ciphers of host, in order of preference. Lists that
+// modify the default set, starting with '+', '-' or '^', are not supported
+// and keep the crypto/ssh defaults. Ciphers crypto/ssh lacks are skipped
+// when dialing. Spaces around the names are ignored.
+func ciphers(cfg *ssh_config.Config, host string) ([]string, error) {
+	s, err := cfg.Get(host, "Ciphers")
+	s = strings.TrimSpace(s)
+	if err != nil || s == "" || strings.ContainsAny(s[:1], "+-^") {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func LoadConfig() (*Config, error) {
+	path, err := defaultConfigPath()
 	if err != nil {
 		slog.Error("Failed to get configuration directory", "error", err)
 		return nil, err
 	}
+	return LoadConfigFile(path)
+}
+
+// LoadConfigFile loads the configuration at path and resolves the SSH chain
+// of every proxy from the ssh_config file.
+func LoadConfigFile(path string) (*Config, error) {
+	config := &Config{}
+
+	if _, err := toml.DecodeFile(path, config); err != nil {
+		slog.Error("Failed to load configuration file", "file", path, "error", err)
+		return nil, err
+	}
+	slog.Debug("Configuration loaded", "file", path, "listeners", config.listeners(), "proxies", len(config.Proxies))
 
-	if _, err := toml.DecodeFile(filepath.Join(configDir, "config.toml"), config); err != nil {
-		slog.Error("Failed to load configuration file", "file", "config.toml", "error", err)
+	for _, lc := range config.listeners() {
+		// Without port nor [[listener]], proxs serves the sockets passed by
+		// systemd, which openListeners checks for.
+		if len(config.Listeners) == 0 && lc.Port == 0 {
+			continue
+		}
+		if err := lc.validate(config.Proxies); err != nil {
+			slog.Error("Invalid listener configuration", "error", err)
+			return nil, err
+		}
+	}
+	if err := config.Admin.validate(); err != nil {
+		slog.Error("Invalid admin configuration", "error", err)
+		return nil, err
+	}
+	if err := config.Log.validate(); err != nil {
+		slog.Error("Invalid log configuration", "error", err)
+		return nil, err
+	}
+	if err := config.AccessLog.validate(); err != nil {
+		slog.Error("Invalid access log configuration", "error", err)
+		return nil, err
+	}
+	if err := config.Timeouts.validate(); err != nil {
+		slog.Error("Invalid timeouts configuration", "error", err)
+		return nil, err
+	}
+	if err := config.Relay.validate(); err != nil {
+		slog.Error("Invalid relay configuration", "error", err)
+		return nil, err
+	}
+	if err := config.Limits.validate(); err != nil {
+		slog.Error("Invalid limits configuration", "error", err)
+		return nil, err
+	}
+	config.clientLimits = newClientLimits(config.Limits.Client)
+	if err := config.ACL.validate(); err != nil {
+		slog.Error("Invalid ACL configuration", "error", err)
 		return nil, err
 	}
-	slog.Debug("Configuration loaded", "config", config)
 
 	for key := range config.Proxies {
 		proxy := config.Proxies[key]
-		proxy.Connection, err = makeNestedSshConnection(proxy.Host)
-		if err != nil {
-			slog.Error("Failed to create sshConnection from ssh config", "host", proxy.Host, "error", err)
+		proxy.Name = key
+		if err := proxy.validate(); err != nil {
+			slog.Error("Invalid proxy configuration", "error", err)
 			return nil, err
 		}
+		for _, host := range proxy.hosts() {
+			conn, err := makeNestedSshConnection(host)
+			if err != nil {
+				slog.Error("Failed to create sshConnection from ssh config", "host", host, "error", err)
+				return nil, err
+			}
+			var pin *HostKeyPin
+			if proxy.HostKey.isSet() {
+				pin = &proxy.HostKey
+			}
+			for _, hop := range conn.Chain() {
+				if hop.ConnectTimeout == 0 {
+					hop.ConnectTimeout = config.Timeouts.connect()
+				}
+				hop.HostKey = pin
+			}
+			proxy.Connections = append(proxy.Connections, conn)
+		}
+		proxy.channelOpenTimeout = config.Timeouts.channelOpen()
+		proxy.Connection = proxy.Connections[0]
+		proxy.pool = newProxyPool(proxy)
+		proxy.limits = newProxyLimits(proxy)
 		config.Proxies[key] = proxy
 	}
 	return config, nil
 }
 
+func defaultConfigPath() (string, error) {
+	configDir, err := configDir("proxs")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "config.toml"), nil
+}
+
 func configDir(app string) (string, error) {
 	if x := os.Getenv("XDG_CONFIG_HOME"); x != "" {
 		return filepath.Join(x, app), nil
@@ -2,7 +2,12 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
 )
 
 func TestMakeNestedSshConnection(t *testing.T) {
@@ -87,3 +92,186 @@ Host testhost_with_jump
 		t.Errorf("expected jump host port 22, got %d", connWithJump.JumpHost.Port)
 	}
 }
+
+func TestListenerConfig(t *testing.T) {
+	proxies := map[string]sshProxy{"env1": {Host: "env1"}}
+
+	tests := []struct {
+		name        string
+		listener    ListenerConfig
+		wantNetwork string
+		wantAddr    string
+		wantErr     bool
+	}{
+		{
+			name:        "IPv4",
+			listener:    ListenerConfig{Address: "172.17.0.1", Port: 1080, Protocol: protocolSOCKS5},
+			wantNetwork: "tcp",
+			wantAddr:    "172.17.0.1:1080",
+		},
+		{
+			name:        "IPv6",
+			listener:    ListenerConfig{Address: "::1", Port: 1080, Protocol: protocolMixed},
+			wantNetwork: "tcp",
+			wantAddr:    "[::1]:1080",
+		},
+		{
+			name:        "Unix socket",
+			listener:    ListenerConfig{Socket: "/run/proxs.sock", SocketMode: "0660", Protocol: protocolHTTP, Proxies: []string{"env1"}},
+			wantNetwork: "unix",
+			wantAddr:    "/run/proxs.sock",
+		},
+		{
+			name:     "Socket with port",
+			listener: ListenerConfig{Socket: "/run/proxs.sock", Port: 1080, Protocol: protocolSOCKS5},
+			wantErr:  true,
+		},
+		{
+			name:     "Invalid socket mode",
+			listener: ListenerConfig{Socket: "/run/proxs.sock", SocketMode: "rw", Protocol: protocolSOCKS5},
+			wantErr:  true,
+		},
+		{
+			name:     "Hostname address",
+			listener: ListenerConfig{Address: "localhost", Port: 1080, Protocol: protocolSOCKS5},
+			wantErr:  true,
+		},
+		{
+			name:     "Unknown protocol",
+			listener: ListenerConfig{Address: "127.0.0.1", Port: 1080, Protocol: "socks6"},
+			wantErr:  true,
+		},
+		{
+			name:     "Unknown proxy",
+			listener: ListenerConfig{Address: "127.0.0.1", Port: 1080, Protocol: protocolSOCKS5, Proxies: []string{"env2"}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.listener.validate(proxies)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("validate() expected error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validate() unexpected error: %v", err)
+			}
+			if got := tt.listener.Network(); got != tt.wantNetwork {
+				t.Errorf("Network() = %s, expected %s", got, tt.wantNetwork)
+			}
+			if got := tt.listener.Addr(); got != tt.wantAddr {
+				t.Errorf("Addr() = %s, expected %s", got, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestConfigListeners(t *testing.T) {
+	var cfg Config
+	if _, err := toml.Decode(`
+port = 8080
+
+[proxy.env1]
+host = "env1"
+
+[proxy.env2]
+host = "env2"
+
+[[listener]]
+address = "127.0.0.1"
+port = 1080
+
+[[listener]]
+socket = "/tmp/proxs.sock"
+protocol = "http"
+proxies = ["env2"]
+`, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := cfg.listeners()
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(listeners))
+	}
+	if listeners[0].Protocol != protocolSOCKS5 {
+		t.Errorf("expected default protocol socks5, got %s", listeners[0].Protocol)
+	}
+	if got := cfg.proxiesFor(listeners[0]); len(got) != 2 {
+		t.Errorf("expected all proxies for unrestricted listener, got %d", len(got))
+	}
+	if got := cfg.proxiesFor(listeners[1]); len(got) != 1 || got[0].Host != "env2" {
+		t.Errorf("expected only env2 for restricted listener, got %+v", got)
+	}
+
+	// Without [[listener]] tables the legacy port is used.
+	legacy := Config{ListenPort: 8080}
+	if got := legacy.listeners(); len(got) != 1 || got[0].Addr() != "127.0.0.1:8080" {
+		t.Errorf("expected legacy listener on 127.0.0.1:8080, got %+v", got)
+	}
+
+	// TCP listeners without an address stay on loopback.
+	noAddress := Config{Listeners: []ListenerConfig{{Port: 1080}}}
+	if got := noAddress.listeners(); got[0].Addr() != "127.0.0.1:1080" {
+		t.Errorf("expected listener without address on 127.0.0.1:1080, got %s", got[0].Addr())
+	}
+}
+
+func TestServerAliveSettings(t *testing.T) {
+	sshConfig := filepath.Join(t.TempDir(), "ssh_config")
+	writeTestFile(t, sshConfig, `
+Host bastion
+    ServerAliveInterval 15
+    ServerAliveCountMax 2
+Host env1
+    ProxyJump bastion
+`)
+	t.Setenv("SSH_CONFIG_FILE", sshConfig)
+
+	sc, err := makeNestedSshConnection("env1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.ServerAliveInterval != 0 || sc.ServerAliveCountMax != 3 {
+		t.Errorf("env1 keepalive = %v/%d, expected 0s/3", sc.ServerAliveInterval, sc.ServerAliveCountMax)
+	}
+	if jh := sc.JumpHost; jh.ServerAliveInterval != 15*time.Second || jh.ServerAliveCountMax != 2 {
+		t.Errorf("bastion keepalive = %v/%d, expected 15s/2", jh.ServerAliveInterval, jh.ServerAliveCountMax)
+	}
+}
+
+func TestCiphers(t *testing.T) {
+	sshConfig := filepath.Join(t.TempDir(), "ssh_config")
+	writeTestFile(t, sshConfig, `
+Host fast
+    Ciphers aes128-gcm@openssh.com,chacha20-poly1305@openssh.com
+Host spaced
+    Ciphers aes128-gcm@openssh.com, chacha20-poly1305@openssh.com
+Host modified
+    Ciphers +aes128-cbc
+Host plain
+`)
+	t.Setenv("SSH_CONFIG_FILE", sshConfig)
+
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{"fast", []string{"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com"}},
+		{"spaced", []string{"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com"}},
+		{"modified", nil},
+		{"plain", nil},
+	}
+	for _, tt := range tests {
+		sc, err := makeNestedSshConnection(tt.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(sc.Ciphers, tt.want) {
+			t.Errorf("%s: Ciphers = %v, expected %v", tt.host, sc.Ciphers, tt.want)
+		}
+	}
+}
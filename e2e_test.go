@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bean1310/proxs/internal/sshtest"
+	"golang.org/x/net/proxy"
+)
+
+// startProxs loads config.toml and ssh_config with the given contents,
+// serves them on a loopback port accepting both SOCKS5 and HTTP CONNECT, and
+// returns its address.
+func startProxs(t testing.TB, sshConfig, config string) string {
+	t.Helper()
+	return startProxsListener(t, sshConfig, config, ListenerConfig{Address: "127.0.0.1", Protocol: protocolMixed})
+}
+
+// startProxsListener is startProxs with a listener configured by lc
+// instead, whose address and port are ignored.
+func startProxsListener(t testing.TB, sshConfig, config string, lc ListenerConfig) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	sshConfigPath := filepath.Join(dir, "ssh_config")
+	writeTestFile(t, sshConfigPath, sshConfig)
+	t.Setenv("SSH_CONFIG_FILE", sshConfigPath)
+	configPath := filepath.Join(dir, "config.toml")
+	writeTestFile(t, configPath, "port = 1080\n"+config)
+
+	cfg, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg, []boundListener{{ln, lc}})
+	srv.Serve()
+	t.Cleanup(func() {
+		srv.Shutdown(time.Second)
+		for _, pool := range cfg.pools() {
+			pool.Close()
+		}
+	})
+	return ln.Addr().String()
+}
+
+// sshHost returns the ssh_config entry of srv named host, reached through
+// jump when it is not empty.
+func sshHost(host string, srv *sshtest.Server, jump string) string {
+	entry := fmt.Sprintf("Host %s\n    HostName 127.0.0.1\n    Port %d\n    User test\n", host, srv.Port())
+	if jump != "" {
+		entry += "    ProxyJump " + jump + "\n"
+	}
+	return entry
+}
+
+// socksDial connects to addr through the SOCKS5 proxy at proxyAddr.
+func socksDial(t *testing.T, proxyAddr, addr string) (net.Conn, error) {
+	t.Helper()
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+// connectStatus sends an HTTP CONNECT request for addr to the proxy at
+// proxyAddr and returns the status of the response.
+func connectStatus(t *testing.T, proxyAddr, addr string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+// echo writes msg to conn and returns what is read back.
+func echo(t *testing.T, conn net.Conn, msg string) string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	return string(got)
+}
+
+func TestEndToEndSOCKS5(t *testing.T) {
+	key := sshtest.UseAgent(t)
+	target := sshtest.NewEchoServer(t)
+
+	proxyHost := sshtest.NewServer(t, sshtest.WithAuthorizedKeys(key), sshtest.PermitOnly(target))
+	jump2 := sshtest.NewServer(t, sshtest.WithAuthorizedKeys(key), sshtest.PermitOnly(proxyHost.Addr.String()))
+	jump1 := sshtest.NewServer(t, sshtest.WithAuthorizedKeys(key), sshtest.PermitOnly(jump2.Addr.String()))
+
+	tests := []struct {
+		name      string
+		sshConfig string
+		// hops are the servers of the chain, which each forward to the
+		// next one and the last one to the target.
+		hops []*sshtest.Server
+	}{
+		{
+			name:      "Single hop",
+			sshConfig: sshHost("proxyhost", proxyHost, ""),
+			hops:      []*sshtest.Server{proxyHost},
+		},
+		{
+			name:      "Jump host",
+			sshConfig: sshHost("jump2", jump2, "") + sshHost("proxyhost", proxyHost, "jump2"),
+			hops:      []*sshtest.Server{jump2, proxyHost},
+		},
+		{
+			name:      "Nested jump hosts",
+			sshConfig: sshHost("jump1", jump1, "") + sshHost("jump2", jump2, "jump1") + sshHost("proxyhost", proxyHost, "jump2"),
+			hops:      []*sshtest.Server{jump1, jump2, proxyHost},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before [][]string
+			for _, hop := range tt.hops {
+				before = append(before, hop.Forwarded())
+			}
+
+			addr := startProxs(t, tt.sshConfig, `
+[proxy.env1]
+host = "proxyhost"
+target_addrs = ["127.0.0.1"]
+`)
+			conn, err := socksDial(t, addr, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := echo(t, conn, "hello"); got != "hello" {
+				t.Errorf("echoed %q, expected %q", got, "hello")
+			}
+
+			for i, hop := range tt.hops {
+				next := target
+				if i+1 < len(tt.hops) {
+					next = tt.hops[i+1].Addr.String()
+				}
+				if forwarded := hop.Forwarded()[len(before[i]):]; !slices.Equal(forwarded, []string{next}) {
+					t.Errorf("hop %d forwarded to %v, expected %v", i, forwarded, []string{next})
+				}
+			}
+		})
+	}
+}
+
+func TestEndToEndHTTPConnect(t *testing.T) {
+	key := sshtest.UseAgent(t)
+	target := sshtest.NewHTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.URL.Path)
+	}))
+	proxyHost := sshtest.NewServer(t, sshtest.WithAuthorizedKeys(key))
+	jump := sshtest.NewServer(t, sshtest.WithAuthorizedKeys(key), sshtest.PermitOnly(proxyHost.Addr.String()))
+
+	addr := startProxs(t, sshHost("jump", jump, "")+sshHost("proxyhost", proxyHost, "jump"), `
+[proxy.env1]
+host = "proxyhost"
+target_addrs = ["127.0.0.1"]
+`)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// The tunnel carries HTTP requests to the target.
+	for _, path := range []string{"/first", "/second"} {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, target)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "hello from " + path; string(body) != expected {
+			t.Errorf("body = %q, expected %q", body, expected)
+		}
+	}
+}
+
+// TestEndToEndSOCKS5OverHTTPClient drives an http.Client whose connections
+// are dialed through proxs by the x/net/proxy SOCKS5 client.
+func TestEndToEndSOCKS5OverHTTPClient(t *testing.T) {
+	key := sshtest.UseAgent(t)
+	target := sshtest.NewHTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 1<<20))
+	}))
+	proxyHost := sshtest.NewServer(t, sshtest.WithAuthorizedKeys(key))
+	addr := startProxs(t, sshHost("proxyhost", proxyHost, ""), `
+[proxy.env1]
+host = "proxyhost"
+target_addrs = ["127.0.0.1"]
+`)
+
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: dialer.(proxy.ContextDialer).DialContext},
+		Timeout:   10 * time.Second,
+	}
+	defer client.CloseIdleConnections()
+
+	for range 3 {
+		resp, err := client.Get("http://" + target + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil || n != 1<<20 {
+			t.Fatalf("read %d bytes (error %v), expected %d", n, err, 1<<20)
+		}
+	}
+	// The client reused its connection, and proxs its SSH connection.
+	if n := proxyHost.Conns(); n != 1 {
+		t.Errorf("proxy host accepted %d SSH connections, expected 1", n)
+	}
+}
+
+func TestEndToEndFailures(t *testing.T) {
+	sshtest.UseAgent(t)
+	target := sshtest.NewEchoServer(t)
+
+	// The servers only accept a key the agent does not hold.
+	stranger := sshtest.NewSigner(t).PublicKey()
+	unauthorized := sshtest.NewServer(t, sshtest.WithAuthorizedKeys(stranger))
+	prohibited := sshtest.NewServer(t, sshtest.PermitOnly("127.0.0.1:1"))
+
+	addr := startProxs(t, sshHost("unauthorized", unauthorized, "")+sshHost("prohibited", prohibited, ""), `
+[proxy.unauthorized]
+host = "unauthorized"
+target_addrs = ["127.0.0.1"]
+
+[proxy.prohibited]
+host = "prohibited"
+target_addrs = ["localhost"]
+`)
+	_, port, _ := net.SplitHostPort(target)
+
+	tests := []struct {
+		name     string
+		addr     string
+		expected string
+		code     int
+	}{
+		{"Authentication failure", target, "general SOCKS server failure", http.StatusBadGateway},
+		{"Forwarding prohibited", net.JoinHostPort("localhost", port), "connection not allowed by ruleset", http.StatusBadGateway},
+		{"No matching proxy", net.JoinHostPort("unrouted.test", port), "connection not allowed by ruleset", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := socksDial(t, addr, tt.addr); err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("SOCKS5 dial error = %v, expected %q", err, tt.expected)
+			}
+
+			if code := connectStatus(t, addr, tt.addr); code != tt.code {
+				t.Errorf("CONNECT status = %d, expected %d", code, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+const (
+	failoverOrdered  = "ordered"
+	failoverWeighted = "weighted"
+
+	defaultRaceDelay = 250 * time.Millisecond
+
+	// memberRetryAfter is how long a member whose dial or probe failed is
+	// tried only after the others.
+	memberRetryAfter = 30 * time.Second
+)
+
+// FailoverConfig describes how a proxy with several hosts picks the one to
+// dial. Ordered groups try the hosts in the configured order; weighted
+// groups in a random order biased by Weights. With Race set, the next host
+// is dialed in parallel when the previous one has not connected within
+// RaceDelay, and the first chain to connect wins. With ProbeInterval set,
+// the hosts not in use are dialed periodically so that a failed one is
+// skipped before a request has to wait for it.
+type FailoverConfig struct {
+	Strategy      string        `toml:"strategy"`
+	Weights       []int         `toml:"weights"`
+	Race          bool          `toml:"race"`
+	RaceDelay     time.Duration `toml:"race_delay"`
+	ProbeInterval time.Duration `toml:"probe_interval"`
+}
+
+func (fc FailoverConfig) validate(hosts int) error {
+	switch fc.Strategy {
+	case "", failoverOrdered:
+		if len(fc.Weights) > 0 {
+			return fmt.Errorf("weights require strategy %q", failoverWeighted)
+		}
+	case failoverWeighted:
+		if len(fc.Weights) != hosts {
+			return fmt.Errorf("%d weights given for %d hosts", len(fc.Weights), hosts)
+		}
+		for _, w := range fc.Weights {
+			if w <= 0 {
+				return fmt.Errorf("weights must be positive")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown failover strategy %q", fc.Strategy)
+	}
+	if fc.RaceDelay < 0 || fc.ProbeInterval < 0 {
+		return fmt.Errorf("race_delay and probe_interval cannot be negative")
+	}
+	return nil
+}
+
+func (fc FailoverConfig) Equal(other FailoverConfig) bool {
+	return fc.Strategy == other.Strategy &&
+		slices.Equal(fc.Weights, other.Weights) &&
+		fc.Race == other.Race &&
+		fc.RaceDelay == other.RaceDelay &&
+		fc.ProbeInterval == other.ProbeInterval
+}
+
+func (fc FailoverConfig) raceDelay() time.Duration {
+	if fc.RaceDelay == 0 {
+		return defaultRaceDelay
+	}
+	return fc.RaceDelay
+}
+
+// groupMember is one host of a proxy's failover group. Its state is
+// guarded by the pool's mutex.
+type groupMember struct {
+	conn   *sshConnection
+	weight int
+
+	lastError error
+	failedAt  time.Time
+}
+
+// available reports whether m has not failed recently.
+func (m *groupMember) available(now time.Time) bool {
+	return m.lastError == nil || now.Sub(m.failedAt) > memberRetryAfter
+}
+
+// memberStats is the state of one host of a failover group.
+type memberStats struct {
+	Address   string `json:"address"`
+	Active    bool   `json:"active"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (m *groupMember) stats(active bool) memberStats {
+	st := memberStats{Address: m.conn.String(), Active: active}
+	if m.lastError != nil {
+		st.LastError = m.lastError.Error()
+	}
+	return st
+}
+
+// membersInUse returns the members with an active client. p.mu must be
+// held.
+func (p *sshPool) membersInUse() map[*groupMember]bool {
+	inUse := make(map[*groupMember]bool)
+	for _, pc := range p.active {
+		inUse[pc.member] = true
+	}
+	return inUse
+}
+
+// dialOrder returns the members to dial, without exclude, in the order
+// given by the strategy, with the members that failed recently last.
+func (p *sshPool) dialOrder(exclude *groupMember) []*groupMember {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var order []*groupMember
+	if p.failover.Strategy == failoverWeighted {
+		order = weightedShuffle(p.members)
+	} else {
+		order = slices.Clone(p.members)
+	}
+	order = slices.DeleteFunc(order, func(m *groupMember) bool { return m == exclude })
+
+	now := time.Now()
+	slices.SortStableFunc(order, func(a, b *groupMember) int {
+		switch aa, ba := a.available(now), b.available(now); {
+		case aa && !ba:
+			return -1
+		case !aa && ba:
+			return 1
+		}
+		return 0
+	})
+	return order
+}
+
+// weightedShuffle returns members in a random order where each position is
+// drawn with a probability proportional to the weights of the members left.
+func weightedShuffle(members []*groupMember) []*groupMember {
+	left := slices.Clone(members)
+	order := make([]*groupMember, 0, len(members))
+	for len(left) > 0 {
+		total := 0
+		for _, m := range left {
+			total += m.weight
+		}
+		n := rand.IntN(total)
+		for i, m := range left {
+			if n < m.weight {
+				order = append(order, m)
+				left = slices.Delete(left, i, i+1)
+				break
+			}
+			n -= m.weight
+		}
+	}
+	return order
+}
+
+// dialGroup dials the chain of a member of the group other than exclude,
+// trying them in turn or racing them.
+func (p *sshPool) dialGroup(ctx context.Context, exclude *groupMember) (*poolClient, error) {
+	order := p.dialOrder(exclude)
+	if len(order) == 0 {
+		return nil, fmt.Errorf("no alternate host for proxy %s", p.name)
+	}
+	if p.failover.Race && len(order) > 1 {
+		return p.raceMembers(ctx, order)
+	}
+
+	var errs []error
+	for _, m := range order {
+		pc, err := p.dialMember(ctx, m)
+		if err == nil {
+			return pc, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// raceMembers dials members "happy eyeballs" style: the next member is
+// dialed whenever the previous dials failed or have not completed within
+// the race delay. The first chain to connect is returned and the others
+// are closed.
+func (p *sshPool) raceMembers(ctx context.Context, members []*groupMember) (*poolClient, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		pc  *poolClient
+		err error
+	}
+	results := make(chan result, len(members))
+	next, pending := 0, 0
+	start := func() {
+		m := members[next]
+		next++
+		pending++
+		go func() {
+			pc, err := p.dialMember(ctx, m)
+			results <- result{pc, err}
+		}()
+	}
+
+	delay := p.failover.raceDelay()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(members) {
+				start()
+				timer.Reset(delay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(losers int) {
+					for range losers {
+						if r := <-results; r.err == nil {
+							r.pc.cleanup()
+						}
+					}
+				}(pending)
+				return r.pc, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(members) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialMember dials the chain of m and records the outcome.
+func (p *sshPool) dialMember(ctx context.Context, m *groupMember) (*poolClient, error) {
+	client, cleanup, err := m.conn.Dial(ctx, "tcp", "")
+	if err != nil {
+		if ctx.Err() == nil {
+			p.mu.Lock()
+			m.lastError, m.failedAt = err, time.Now()
+			p.mu.Unlock()
+		}
+		if len(p.members) > 1 {
+			err = fmt.Errorf("%s: %w", m.conn, err)
+		}
+		return nil, err
+	}
+
+	p.mu.Lock()
+	m.lastError = nil
+	p.mu.Unlock()
+	return &poolClient{client: client, cleanup: cleanup, member: m}, nil
+}
+
+// probeLoop dials the members that are not in use every interval, so that
+// their failures are known before a request needs them.
+func (p *sshPool) probeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		inUse := p.membersInUse()
+		p.mu.Unlock()
+
+		for _, m := range p.members {
+			if inUse[m] {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), reconnectTimeout)
+			pc, err := p.dialMember(ctx, m)
+			cancel()
+			if err != nil {
+				slog.Debug("SSH host probe failed", "proxy", p.name, "host", m.conn.String(), "error", err)
+				continue
+			}
+			pc.cleanup()
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bean1310/proxs/internal/sshtest"
+)
+
+func TestFailoverConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		fc      FailoverConfig
+		hosts   int
+		wantErr bool
+	}{
+		{"default", FailoverConfig{}, 2, false},
+		{"weighted", FailoverConfig{Strategy: failoverWeighted, Weights: []int{3, 1}}, 2, false},
+		{"weights without strategy", FailoverConfig{Weights: []int{3, 1}}, 2, true},
+		{"missing weight", FailoverConfig{Strategy: failoverWeighted, Weights: []int{3}}, 2, true},
+		{"zero weight", FailoverConfig{Strategy: failoverWeighted, Weights: []int{3, 0}}, 2, true},
+		{"unknown strategy", FailoverConfig{Strategy: "random"}, 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fc.validate(tt.hosts); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	heavy := &groupMember{weight: 9}
+	light := &groupMember{weight: 1}
+
+	first := 0
+	for range 1000 {
+		order := weightedShuffle([]*groupMember{light, heavy})
+		if len(order) != 2 || order[0] == order[1] {
+			t.Fatalf("weightedShuffle() = %v, expected both members once", order)
+		}
+		if order[0] == heavy {
+			first++
+		}
+	}
+	// Expected 900; the bounds leave room for randomness.
+	if first < 800 || first > 980 {
+		t.Errorf("heavy member first %d times out of 1000, expected about 900", first)
+	}
+}
+
+func TestDialGroupFailover(t *testing.T) {
+	// Without an agent every dial fails before touching the network.
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	primary := &sshConnection{HostName: "bastion-a", Port: 22, User: "jump"}
+	secondary := &sshConnection{HostName: "bastion-b", Port: 22, User: "jump"}
+	p := newProxyPool(sshProxy{Name: "env1", Connections: []*sshConnection{primary, secondary}})
+	defer p.Close()
+
+	if order := p.dialOrder(nil); order[0].conn != primary {
+		t.Errorf("dialOrder() starts with %s, expected %s", order[0].conn, primary)
+	}
+	if order := p.dialOrder(p.members[0]); len(order) != 1 || order[0].conn != secondary {
+		t.Errorf("dialOrder() without the primary = %v, expected only %s", order, secondary)
+	}
+
+	_, err := p.dialGroup(context.Background(), nil)
+	if err == nil {
+		t.Fatal("dialGroup() expected error, but got none")
+	}
+	for _, host := range []string{"bastion-a", "bastion-b"} {
+		if !strings.Contains(err.Error(), host) {
+			t.Errorf("dialGroup() error %q does not mention %s", err, host)
+		}
+	}
+
+	// Once both failed, neither is preferred, so the configured order holds.
+	if order := p.dialOrder(nil); order[0].conn != primary {
+		t.Errorf("dialOrder() after failures starts with %s, expected %s", order[0].conn, primary)
+	}
+	p.mu.Lock()
+	p.members[1].lastError = nil
+	p.mu.Unlock()
+	if order := p.dialOrder(nil); order[0].conn != secondary {
+		t.Errorf("dialOrder() starts with failed %s, expected %s", order[0].conn, secondary)
+	}
+
+	if st := p.stats(); len(st.Members) != 2 || st.Members[0].LastError == "" {
+		t.Errorf("stats().Members = %+v, expected both hosts with the primary's error", st.Members)
+	}
+}
+
+func TestLoadConfigFailoverGroup(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[proxy.group]
+hosts = ["env1", "env2"]
+target_addrs = ["*.group.internal"]
+
+[proxy.group.failover]
+strategy = "weighted"
+weights = [2, 1]
+race = true
+`)
+	cfg, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := cfg.Proxies["group"]
+	if len(group.Connections) != 2 || group.Connection != group.Connections[0] || group.Connections[1].HostName != "env2.example.com" {
+		t.Errorf("unexpected connections %v", group.Connections)
+	}
+	if !group.Failover.Race || group.Failover.raceDelay() != defaultRaceDelay {
+		t.Errorf("unexpected failover settings %+v", group.Failover)
+	}
+
+	changed := group
+	changed.Failover.Weights = []int{1, 1}
+	if !group.sameChains(group) || group.sameChains(changed) {
+		t.Error("sameChains() does not account for the failover settings")
+	}
+}
+
+func TestProbeStartsWithFirstRequest(t *testing.T) {
+	sshtest.UseAgent(t)
+	primary := sshtest.NewServer(t)
+	secondary := sshtest.NewServer(t)
+
+	p := newProxyPool(sshProxy{
+		Name:        "env1",
+		Connections: []*sshConnection{sshConn(primary, nil), sshConn(secondary, nil)},
+		Failover:    FailoverConfig{ProbeInterval: 10 * time.Millisecond},
+	})
+	defer p.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := primary.Conns() + secondary.Conns(); n != 0 {
+		t.Fatalf("unused pool dialed %d times, expected probing to wait for a request", n)
+	}
+
+	if _, err := p.get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the unused host to be probed", func() bool { return secondary.Conns() > 0 })
+}
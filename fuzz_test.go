@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The fuzz targets below check that every parser either rejects its input
+// or accepts exactly the bytes that the matching encoder produces for the
+// parsed value. Their seed corpora are in testdata/fuzz; run one with e.g.
+//
+//	go test -run '^$' -fuzz FuzzParseRequest
+
+func encodeAuthMethods(am AuthMethods) []byte {
+	return append([]byte{am.Ver, byte(len(am.Methods))}, am.Methods...)
+}
+
+func encodeRequest(req Request) []byte {
+	b := []byte{req.Ver, req.Command, 0, req.AddrType}
+	switch req.AddrType {
+	case 0x01:
+		b = append(b, net.ParseIP(req.DestAddr).To4()...)
+	case 0x04:
+		b = append(b, net.ParseIP(req.DestAddr).To16()...)
+	default:
+		b = append(b, byte(len(req.DestAddr)))
+		b = append(b, req.DestAddr...)
+	}
+	return append(b, byte(req.DestPort>>8), byte(req.DestPort))
+}
+
+func encodeUserPass(up UserPassRequest) []byte {
+	b := []byte{up.Ver, byte(len(up.Username))}
+	b = append(b, up.Username...)
+	b = append(b, byte(len(up.Password)))
+	return append(b, up.Password...)
+}
+
+func encodeSocks4Request(req Socks4Request) []byte {
+	b := []byte{req.Ver, req.Command, byte(req.DestPort >> 8), byte(req.DestPort)}
+	b = append(b, req.DestIP[:]...)
+	b = append(b, req.UserID...)
+	b = append(b, 0)
+	if socks4a(req.DestIP) {
+		b = append(b, req.DestAddr...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+func encodeConnectRequest(cr clientRequest) []byte {
+	return fmt.Appendf(nil, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", cr.Addr(), cr.Addr())
+}
+
+// consumed returns the prefix of data that a parser read from r.
+func consumed(data []byte, r *bytes.Reader) []byte {
+	return data[:len(data)-r.Len()]
+}
+
+func FuzzParseAuthMethod(f *testing.F) {
+	f.Add([]byte{5, 1, 0})
+	f.Add([]byte{5, 2, 0, 2})
+	f.Add([]byte{5, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		am, err := ParseAuthMethod(r)
+		if err != nil {
+			return
+		}
+		if int(am.NMethods) != len(am.Methods) {
+			t.Fatalf("NMethods = %d, but %d methods", am.NMethods, len(am.Methods))
+		}
+		if enc := encodeAuthMethods(am); !bytes.Equal(enc, consumed(data, r)) {
+			t.Fatalf("parsed %x from %x, which encodes as %x", am, consumed(data, r), enc)
+		}
+	})
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add(createSOCKS5Request("example.com", 443))
+	f.Add([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 22})
+	f.Add([]byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90})
+	f.Add([]byte{5, 2, 0, 1, 10, 0, 0, 1, 0, 22})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		req, err := ParseRequest(r)
+		if err != nil {
+			return
+		}
+		// RSV is ignored, and always encoded as zero.
+		read := bytes.Clone(consumed(data, r))
+		read[2] = 0
+		if enc := encodeRequest(req); !bytes.Equal(enc, read) {
+			t.Fatalf("parsed %+v from %x, which encodes as %x", req, read, enc)
+		}
+	})
+}
+
+func FuzzParseUserPassRequest(f *testing.F) {
+	f.Add(createUserPassRequest("alice", "secret"))
+	f.Add([]byte{1, 0, 0})
+	f.Add([]byte{2, 1, 'a', 1, 'b'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		up, err := ParseUserPassRequest(r)
+		if err != nil {
+			return
+		}
+		if enc := encodeUserPass(up); !bytes.Equal(enc, consumed(data, r)) {
+			t.Fatalf("parsed %+v from %x, which encodes as %x", up, consumed(data, r), enc)
+		}
+	})
+}
+
+func FuzzParseSocks4Request(f *testing.F) {
+	f.Add([]byte{4, 1, 1, 187, 10, 0, 0, 1, 'b', 'o', 'b', 0})
+	f.Add(append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com\x00"...))
+	f.Add([]byte{4, 2, 0, 80, 10, 0, 0, 1, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		req, err := ParseSocks4Request(r)
+		if err != nil {
+			return
+		}
+		if len(req.UserID) > maxSocks4Field || len(req.DestAddr) > maxSocks4Field {
+			t.Fatalf("parsed %+v, with a field longer than %d bytes", req, maxSocks4Field)
+		}
+		if enc := encodeSocks4Request(req); !bytes.Equal(enc, consumed(data, r)) {
+			t.Fatalf("parsed %+v from %x, which encodes as %x", req, consumed(data, r), enc)
+		}
+	})
+}
+
+// fuzzConn is a client connection that sends a fixed input and discards
+// what it is sent.
+type fuzzConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c fuzzConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c fuzzConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c fuzzConn) SetDeadline(time.Time) error      { return nil }
+func (c fuzzConn) SetReadDeadline(time.Time) error  { return nil }
+func (c fuzzConn) SetWriteDeadline(time.Time) error { return nil }
+func (c fuzzConn) RemoteAddr() net.Addr             { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c fuzzConn) LocalAddr() net.Addr              { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c fuzzConn) Close() error                     { return nil }
+
+func FuzzHTTPConnect(f *testing.F) {
+	f.Add([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	f.Add([]byte("CONNECT [2001:db8::1]:22 HTTP/1.1\r\n\r\n"))
+	f.Add([]byte("CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n\r\n"))
+	f.Add([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cr, err := httpConnect(context.Background(), fuzzConn{r: bytes.NewReader(data)}, nil)
+		if err != nil {
+			return
+		}
+		if cr.Host == "" || cr.Port == 0 {
+			t.Fatalf("accepted %q with destination %q", data, cr.Addr())
+		}
+		again, err := httpConnect(context.Background(), fuzzConn{r: bytes.NewReader(encodeConnectRequest(cr))}, nil)
+		if err != nil {
+			t.Fatalf("accepted %q, but not its encoding %q: %v", data, encodeConnectRequest(cr), err)
+		}
+		if !reflect.DeepEqual(again, cr) {
+			t.Fatalf("parsed %+v from %q, but %+v from its encoding", cr, data, again)
+		}
+	})
+}
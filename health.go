@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// Health states of a proxy.
+const (
+	healthUp       = "up"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+const (
+	// proxyDownThreshold is the number of consecutive failed dials after
+	// which a proxy is down and requests fail without dialing.
+	proxyDownThreshold = 3
+
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+	reconnectTimeout    = 30 * time.Second
+)
+
+var proxyDownError = errors.New("proxy is down")
+
+// reconnectBackoff returns the delay before reconnect attempt n, starting
+// at 1. The delay doubles with every attempt up to reconnectMaxBackoff,
+// and half of it is random so that instances that lost the same bastion do
+// not redial it in lockstep.
+func reconnectBackoff(n int) time.Duration {
+	d := reconnectMaxBackoff
+	if n < 32 {
+		d = min(reconnectMinBackoff<<(n-1), reconnectMaxBackoff)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// health returns the state of the pool. A proxy is degraded while it is
+// reconnecting, and down once proxyDownThreshold dials failed in a row.
+// p.mu must be held.
+func (p *sshPool) health() string {
+	switch {
+	case p.failures >= proxyDownThreshold:
+		return healthDown
+	case p.failures > 0 || (p.reconnecting && len(p.active) == 0):
+		return healthDegraded
+	}
+	return healthUp
+}
+
+// recordDial updates the health of the pool after a dial of its chain and
+// starts reconnecting in the background when the dial failed. p.mu must be
+// held.
+func (p *sshPool) recordDial(err error) {
+	before := p.health()
+	if err != nil {
+		p.failures++
+		p.lastError, p.lastErrorAt = err, time.Now()
+		p.startReconnect()
+	} else {
+		p.failures = 0
+	}
+
+	if after := p.health(); after != before {
+		if err != nil {
+			slog.Warn("Proxy health changed", "proxy", p.name, "health", after, "failures", p.failures, "error", err)
+		} else {
+			slog.Info("Proxy health changed", "proxy", p.name, "health", after)
+		}
+	}
+}
+
+// startReconnect starts redialing the chain in the background, unless that
+// is already happening. p.mu must be held.
+func (p *sshPool) startReconnect() {
+	if p.reconnecting || p.closed {
+		return
+	}
+	p.reconnecting = true
+	go p.reconnectLoop()
+}
+
+// reconnectLoop redials the chain with exponential backoff until a dial
+// succeeds, whether its own or one made for a request, or the pool is
+// closed.
+func (p *sshPool) reconnectLoop() {
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.reconnecting = false
+		p.nextRetry = time.Time{}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		delay := reconnectBackoff(attempt)
+		p.mu.Lock()
+		p.nextRetry = time.Now().Add(delay)
+		p.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-p.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), reconnectTimeout)
+		_, err := p.connect(ctx)
+		cancel()
+		if err == nil || errors.Is(err, poolClosedError) {
+			return
+		}
+		slog.Debug("Reconnect failed", "proxy", p.name, "attempt", attempt, "error", err)
+	}
+}
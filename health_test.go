@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{4, 4 * time.Second, 8 * time.Second},
+		{10, 30 * time.Second, time.Minute},
+		{100, 30 * time.Second, time.Minute},
+	}
+
+	for _, tt := range tests {
+		for range 20 {
+			if d := reconnectBackoff(tt.attempt); d < tt.min || d > tt.max {
+				t.Errorf("reconnectBackoff(%d) = %v, expected between %v and %v", tt.attempt, d, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestPoolHealth(t *testing.T) {
+	// Without an agent every dial fails before touching the network.
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	p := newSSHPool("env1", &sshConnection{HostName: "127.0.0.1", Port: 22, User: "test"})
+	defer p.Close()
+
+	expected := []string{healthDegraded, healthDegraded, healthDown}
+	for i, health := range expected {
+		_, err := p.Dial(context.Background(), "tcp", "db.internal:5432")
+		if err == nil || errors.Is(err, proxyDownError) {
+			t.Fatalf("Dial() #%d = %v, expected a dial error", i+1, err)
+		}
+		if st := p.stats(); st.Health != health || st.Failures != i+1 {
+			t.Errorf("after %d failures stats() = %s/%d, expected %s", i+1, st.Health, st.Failures, health)
+		}
+	}
+
+	_, err := p.Dial(context.Background(), "tcp", "db.internal:5432")
+	if !errors.Is(err, proxyDownError) {
+		t.Errorf("Dial() on a down proxy = %v, expected %v", err, proxyDownError)
+	}
+	if st := p.stats(); st.NextRetry == nil {
+		t.Error("expected a down proxy to report its next retry")
+	}
+	if err := p.Check(); !errors.Is(err, proxyDownError) {
+		t.Errorf("Check() on a down proxy = %v, expected %v", err, proxyDownError)
+	}
+}
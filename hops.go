@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sharedHops holds the jump host connections of every proxy.
+var sharedHops = newHopRegistry()
+
+// hopRegistry shares jump host connections between chains, so that proxies
+// that all ProxyJump through the same bastion authenticate to it once and
+// multiplex their downstream hops over a single client. Hops are keyed by
+// user, hostname and port along the whole path to them, as the same address
+// reached through different jump hosts may be a different machine, and the
+// host key each client was established with is recorded with it.
+type hopRegistry struct {
+	mu   sync.Mutex
+	hops map[string]*sharedHop
+}
+
+// sharedHop is a jump host client used by refs chains.
+type sharedHop struct {
+	key       string
+	chain     []string
+	client    *ssh.Client
+	cleanup   func()
+	hostKey   string // SHA256 fingerprint presented by the hop
+	refs      int
+	dialing   chan struct{} // closed when the dial completes
+	createdAt time.Time
+}
+
+func newHopRegistry() *hopRegistry {
+	return &hopRegistry{hops: make(map[string]*sharedHop)}
+}
+
+// hopKey identifies the hop sc by the path it is reached through and the
+// host keys each hop of that path is trusted with, so that a hop dialed
+// without verification, or against other pins, is never reused for a chain
+// that pins its host key.
+func hopKey(sc *sshConnection) string {
+	var hops []string
+	for _, hop := range sc.Chain() {
+		hops = append(hops, hop.String()+hop.HostKey.id())
+	}
+	return strings.Join(hops, ">")
+}
+
+// acquire returns a client connected to sc, reusing the one of another
+// chain when there is one. The returned function releases it; the client
+// is closed once every chain using it has released it.
+func (r *hopRegistry) acquire(ctx context.Context, sc *sshConnection) (*ssh.Client, func(), error) {
+	key := hopKey(sc)
+	for {
+		r.mu.Lock()
+		hop, ok := r.hops[key]
+		if ok && hop.dialing != nil {
+			dialing := hop.dialing
+			r.mu.Unlock()
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+		if ok {
+			hop.refs++
+			refs := hop.refs
+			r.mu.Unlock()
+			slog.DebugContext(ctx, "Reusing shared SSH connection to jump host", "hop", sc.String(), "refs", refs)
+			return hop.client, r.releaser(hop), nil
+		}
+
+		hop = &sharedHop{key: key, chain: chainStrings(sc), refs: 1, dialing: make(chan struct{})}
+		r.hops[key] = hop
+		r.mu.Unlock()
+
+		client, hostKey, cleanup, err := sc.dial(ctx, "tcp")
+
+		r.mu.Lock()
+		close(hop.dialing)
+		hop.dialing = nil
+		if err != nil {
+			delete(r.hops, key)
+			r.mu.Unlock()
+			return nil, nil, err
+		}
+		hop.client, hop.cleanup, hop.createdAt = client, cleanup, time.Now()
+		if hostKey != nil {
+			hop.hostKey = ssh.FingerprintSHA256(hostKey)
+		}
+		r.mu.Unlock()
+
+		go r.watch(hop)
+		return client, r.releaser(hop), nil
+	}
+}
+
+// releaser returns the function releasing one reference to hop.
+func (r *hopRegistry) releaser(hop *sharedHop) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			hop.refs--
+			last := hop.refs == 0
+			if last {
+				r.forget(hop)
+			}
+			r.mu.Unlock()
+
+			// The cleanup releases the hop's own jump host, so it must run
+			// without r.mu held.
+			if last {
+				hop.cleanup()
+			}
+		})
+	}
+}
+
+// watch forgets hop once its connection is closed, so that the next chain
+// dials it again instead of reusing a dead client.
+func (r *hopRegistry) watch(hop *sharedHop) {
+	hop.client.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forget(hop)
+}
+
+// forget removes hop from the registry if it is still registered. r.mu
+// must be held.
+func (r *hopRegistry) forget(hop *sharedHop) {
+	if r.hops[hop.key] == hop {
+		delete(r.hops, hop.key)
+	}
+}
+
+// sharedHopStats describes a jump host client shared between chains.
+type sharedHopStats struct {
+	Chain     []string  `json:"chain"`
+	HostKey   string    `json:"host_key,omitempty"`
+	Refs      int       `json:"refs"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (r *hopRegistry) stats() []sharedHopStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var st []sharedHopStats
+	for _, hop := range r.hops {
+		if hop.dialing != nil {
+			continue
+		}
+		st = append(st, sharedHopStats{
+			Chain:     hop.chain,
+			HostKey:   hop.hostKey,
+			Refs:      hop.refs,
+			CreatedAt: hop.createdAt,
+		})
+	}
+	slices.SortFunc(st, func(a, b sharedHopStats) int {
+		return slices.Compare(a.Chain, b.Chain)
+	})
+	return st
+}
+
+// recordingHostKeyCallback wraps cb to remember the host key the server
+// presented, which ssh.Client does not expose.
+func recordingHostKeyCallback(cb ssh.HostKeyCallback, key *ssh.PublicKey) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+		*key = k
+		return cb(hostname, remote, k)
+	}
+}
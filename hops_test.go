@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bean1310/proxs/internal/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshConn returns a connection to srv as user "test", through jump.
+func sshConn(srv *sshtest.Server, jump *sshConnection) *sshConnection {
+	return &sshConnection{HostName: "127.0.0.1", User: "test", Port: srv.Port(), JumpHost: jump}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSharedJumpHost(t *testing.T) {
+	sshtest.UseAgent(t)
+	bastion := sshtest.NewServer(t)
+	target1 := sshtest.NewServer(t)
+	target2 := sshtest.NewServer(t)
+
+	// Proxies reaching the bastion through equal but distinct configurations
+	// share a single connection to it.
+	chains := []*sshConnection{
+		sshConn(target1, sshConn(bastion, nil)),
+		sshConn(target2, sshConn(bastion, nil)),
+		sshConn(target1, sshConn(bastion, nil)),
+	}
+
+	var mu sync.Mutex
+	var cleanups []func()
+	var wg sync.WaitGroup
+	for _, sc := range chains {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, cleanup, err := sc.Dial(context.Background(), "tcp", "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			cleanups = append(cleanups, cleanup)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	if n := bastion.Conns(); n != 1 {
+		t.Errorf("bastion accepted %d connections, expected 1", n)
+	}
+	if n := target1.Conns() + target2.Conns(); n != 3 {
+		t.Errorf("targets accepted %d connections, expected 3", n)
+	}
+	st := sharedHops.stats()
+	if len(st) != 1 || st[0].Refs != 3 || st[0].HostKey == "" {
+		t.Fatalf("sharedHops.stats() = %+v, expected one hop with 3 refs and a host key", st)
+	}
+
+	for _, cleanup := range cleanups[:2] {
+		cleanup()
+	}
+	if st := sharedHops.stats(); len(st) != 1 || st[0].Refs != 1 {
+		t.Errorf("sharedHops.stats() = %+v, expected one hop with 1 ref", st)
+	}
+	cleanups[2]()
+	if st := sharedHops.stats(); len(st) != 0 {
+		t.Errorf("sharedHops.stats() = %+v, expected no hop", st)
+	}
+	waitFor(t, "the bastion connection to close", func() bool { return bastion.Open() == 0 })
+
+	// A new chain dials the bastion again.
+	_, cleanup, err := chains[0].Dial(context.Background(), "tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if n := bastion.Conns(); n != 2 {
+		t.Errorf("bastion accepted %d connections, expected 2", n)
+	}
+}
+
+func TestSharedJumpHostPath(t *testing.T) {
+	sshtest.UseAgent(t)
+	outer := sshtest.NewServer(t)
+	bastion := sshtest.NewServer(t)
+	target := sshtest.NewServer(t)
+
+	// The same bastion address reached directly and through another jump
+	// host are different hops.
+	direct := sshConn(target, sshConn(bastion, nil))
+	nested := sshConn(target, sshConn(bastion, sshConn(outer, nil)))
+	for _, sc := range []*sshConnection{direct, nested} {
+		_, cleanup, err := sc.Dial(context.Background(), "tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+	}
+
+	if n := bastion.Conns(); n != 2 {
+		t.Errorf("bastion accepted %d connections, expected 2", n)
+	}
+	if st := sharedHops.stats(); len(st) != 3 {
+		t.Errorf("sharedHops.stats() = %+v, expected 3 hops", st)
+	}
+}
+
+func TestSharedJumpHostPins(t *testing.T) {
+	sshtest.UseAgent(t)
+	bastion := sshtest.NewServer(t)
+	target := sshtest.NewServer(t)
+
+	// The same bastion trusted without verification, with its key pinned
+	// and with other pins is dialed for each, so that a chain never reuses
+	// a hop dialed under a weaker host key policy.
+	pinned := &HostKeyPin{Fingerprints: []string{ssh.FingerprintSHA256(bastion.HostKey)}}
+	alsoPinned := &HostKeyPin{Fingerprints: []string{ssh.FingerprintSHA256(bastion.HostKey), "SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"}}
+	for _, pin := range []*HostKeyPin{nil, pinned, alsoPinned, pinned} {
+		jump := sshConn(bastion, nil)
+		jump.HostKey = pin
+		_, cleanup, err := sshConn(target, jump).Dial(context.Background(), "tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+	}
+
+	if n := bastion.Conns(); n != 3 {
+		t.Errorf("bastion accepted %d connections, expected one per host key policy", n)
+	}
+	if st := sharedHops.stats(); len(st) != 3 || !slices.Equal(st[0].Chain, chainStrings(sshConn(bastion, nil))) {
+		t.Errorf("sharedHops.stats() = %+v, expected 3 hops named by their address", st)
+	}
+}
+
+func TestSharedJumpHostLost(t *testing.T) {
+	sshtest.UseAgent(t)
+	bastion := sshtest.NewServer(t)
+	target := sshtest.NewServer(t)
+	sc := sshConn(target, sshConn(bastion, nil))
+
+	client, cleanup, err := sc.Dial(context.Background(), "tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	// Losing the bastion forgets it, and the next chain redials it.
+	sharedHops.mu.Lock()
+	hop := sharedHops.hops[hopKey(sc.JumpHost)]
+	sharedHops.mu.Unlock()
+	hop.client.Close()
+	client.Wait()
+	waitFor(t, "the lost hop to be forgotten", func() bool { return len(sharedHops.stats()) == 0 })
+
+	_, cleanup2, err := sc.Dial(context.Background(), "tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup2()
+	if n := bastion.Conns(); n != 2 {
+		t.Errorf("bastion accepted %d connections, expected 2", n)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var hostKeyMismatchError = errors.New("host key not trusted")
+
+// HostKeyPin lists the host keys the hosts of a proxy, and the jump hosts
+// they are reached through, may present, for bastions too short-lived to
+// have stable known_hosts entries. A host is
+// trusted when its key has one of Fingerprints, when it presents a host
+// certificate for its hostname signed by one of CAs, or, when KnownHosts is
+// set, when that known_hosts file lists its key. Hosts of proxies without a
+// pin are not verified.
+type HostKeyPin struct {
+	Fingerprints []string `toml:"fingerprints"`
+	CAs          []string `toml:"cas"`
+	KnownHosts   string   `toml:"known_hosts"`
+}
+
+func (p HostKeyPin) isSet() bool {
+	return len(p.Fingerprints) > 0 || len(p.CAs) > 0 || p.KnownHosts != ""
+}
+
+func (p HostKeyPin) validate() error {
+	for _, fp := range p.Fingerprints {
+		sum, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fp, "SHA256:"))
+		if !strings.HasPrefix(fp, "SHA256:") || err != nil || len(sum) != 32 {
+			return fmt.Errorf("invalid fingerprint %q: expected SHA256:<base64> as printed by ssh-keygen -l", fp)
+		}
+	}
+	if _, err := p.authorities(); err != nil {
+		return err
+	}
+	if p.KnownHosts != "" {
+		if _, err := knownhosts.New(expandHome(p.KnownHosts)); err != nil {
+			return fmt.Errorf("known_hosts: %w", err)
+		}
+	}
+	return nil
+}
+
+// authorities parses CAs, which are public keys in the authorized_keys
+// format, as in the .pub file of the CA. A known_hosts line starting with
+// "@cert-authority <patterns>" is also accepted, ignoring the patterns.
+func (p HostKeyPin) authorities() ([]ssh.PublicKey, error) {
+	var cas []ssh.PublicKey
+	for _, line := range p.CAs {
+		if fields := strings.Fields(line); len(fields) > 2 && fields[0] == "@cert-authority" {
+			line = strings.Join(fields[2:], " ")
+		}
+		ca, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CA public key %q: %w", line, err)
+		}
+		cas = append(cas, ca)
+	}
+	return cas, nil
+}
+
+// Equal reports whether p and other trust the same host keys.
+func (p *HostKeyPin) Equal(other *HostKeyPin) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	return slices.Equal(p.Fingerprints, other.Fingerprints) &&
+		slices.Equal(p.CAs, other.CAs) &&
+		p.KnownHosts == other.KnownHosts
+}
+
+// id identifies the host keys p trusts in hopKey: it is empty for a nil
+// pin, and otherwise a digest of its settings.
+func (p *HostKeyPin) id() string {
+	if p == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(slices.Concat(p.Fingerprints, []string{"\x00"}, p.CAs, []string{"\x00", p.KnownHosts}), "\n")))
+	return "#" + base64.RawStdEncoding.EncodeToString(sum[:8])
+}
+
+// callback returns the host key callback verifying a hop against p. The
+// known_hosts file is read on every call, so that entries added while
+// proxs runs are honoured by the next dial. A nil pin accepts any key.
+func (p *HostKeyPin) callback() (ssh.HostKeyCallback, error) {
+	if p == nil {
+		return ssh.InsecureIgnoreHostKey(), nil // Hops without a pin are not verified
+	}
+	cas, err := p.authorities()
+	if err != nil {
+		return nil, err
+	}
+	var known ssh.HostKeyCallback
+	if p.KnownHosts != "" {
+		if known, err = knownhosts.New(expandHome(p.KnownHosts)); err != nil {
+			return nil, fmt.Errorf("known_hosts: %w", err)
+		}
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			return slices.ContainsFunc(cas, func(ca ssh.PublicKey) bool {
+				return bytes.Equal(ca.Marshal(), auth.Marshal())
+			})
+		},
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		cert, isCert := key.(*ssh.Certificate)
+		if isCert && len(cas) > 0 && checker.CheckHostKey(hostname, remote, key) == nil {
+			return nil
+		}
+		// known_hosts sees the key as presented, so that its
+		// @cert-authority lines vouch for certificates.
+		if known != nil && known(hostname, remote, key) == nil {
+			return nil
+		}
+		// The key of a certificate that no CA vouches for may still be
+		// pinned on its own.
+		pinned := key
+		if isCert {
+			pinned = cert.Key
+		}
+		if slices.Contains(p.Fingerprints, ssh.FingerprintSHA256(pinned)) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s presented %s key %s", hostKeyMismatchError, hostname, key.Type(), ssh.FingerprintSHA256(pinned))
+	}, nil
+}
+
+// expandHome replaces a leading ~/ in path with the home directory.
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bean1310/proxs/internal/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newHostCertSigner returns a host key signed by ca for principals.
+func newHostCertSigner(t testing.TB, ca ssh.Signer, principals ...string) ssh.Signer {
+	t.Helper()
+	key := sshtest.NewSigner(t)
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestHostKeyPinConfig(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	writeTestFile(t, knownHosts, "")
+	ca := authorizedKey(sshtest.NewSigner(t).PublicKey())
+
+	tests := []struct {
+		name    string
+		pin     HostKeyPin
+		wantErr bool
+	}{
+		{name: "Fingerprint", pin: HostKeyPin{Fingerprints: []string{ssh.FingerprintSHA256(sshtest.NewSigner(t).PublicKey())}}},
+		{name: "CA", pin: HostKeyPin{CAs: []string{ca}}},
+		{name: "CA from known_hosts", pin: HostKeyPin{CAs: []string{"@cert-authority *.example.com " + ca}}},
+		{name: "Known hosts", pin: HostKeyPin{KnownHosts: knownHosts}},
+		{name: "Fingerprint without prefix", pin: HostKeyPin{Fingerprints: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"}}, wantErr: true},
+		{name: "MD5 fingerprint", pin: HostKeyPin{Fingerprints: []string{"MD5:16:27:ac:a5:76:28:2d:36:63:1b:56:4d:eb:df:a6:48"}}, wantErr: true},
+		{name: "Truncated fingerprint", pin: HostKeyPin{Fingerprints: []string{"SHA256:47DEQpj8HBSa"}}, wantErr: true},
+		{name: "Invalid CA", pin: HostKeyPin{CAs: []string{"ssh-ed25519 AAAA"}}, wantErr: true},
+		{name: "Missing known_hosts", pin: HostKeyPin{KnownHosts: filepath.Join(t.TempDir(), "missing")}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pin.validate()
+			if tt.wantErr && err == nil {
+				t.Errorf("validate() expected error, but got none")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("validate() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestHostKeyPinCallback(t *testing.T) {
+	pinned := sshtest.NewSigner(t).PublicKey()
+	listed := sshtest.NewSigner(t).PublicKey()
+	other := sshtest.NewSigner(t).PublicKey()
+	ca := sshtest.NewSigner(t)
+	otherCA := sshtest.NewSigner(t)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	writeTestFile(t, knownHosts, knownhosts.Line([]string{knownhosts.Normalize("bastion:2222")}, listed)+"\n")
+
+	pin := &HostKeyPin{
+		Fingerprints: []string{ssh.FingerprintSHA256(pinned)},
+		CAs:          []string{authorizedKey(ca.PublicKey())},
+		KnownHosts:   knownHosts,
+	}
+	cb, err := pin.callback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hostname string
+		key      ssh.PublicKey
+		trusted  bool
+	}{
+		{"Pinned key", "bastion:2222", pinned, true},
+		{"Key in known_hosts", "bastion:2222", listed, true},
+		{"Key in known_hosts for another host", "other:22", listed, false},
+		{"Certificate signed by CA", "bastion:2222", newHostCertSigner(t, ca, "bastion").PublicKey(), true},
+		{"Certificate for another host", "bastion:2222", newHostCertSigner(t, ca, "other").PublicKey(), false},
+		{"Certificate signed by another CA", "bastion:2222", newHostCertSigner(t, otherCA, "bastion").PublicKey(), false},
+		{"Unknown key", "bastion:2222", other, false},
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2222}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := cb(tt.hostname, remote, tt.key)
+			if tt.trusted && err != nil {
+				t.Errorf("callback(%s) = %v, expected nil", tt.hostname, err)
+			}
+			if !tt.trusted && !errors.Is(err, hostKeyMismatchError) {
+				t.Errorf("callback(%s) = %v, expected %v", tt.hostname, err, hostKeyMismatchError)
+			}
+		})
+	}
+
+	// A certificate is checked against the @cert-authority lines of
+	// known_hosts too.
+	knownCAs := filepath.Join(t.TempDir(), "known_hosts")
+	writeTestFile(t, knownCAs, "@cert-authority "+knownhosts.Normalize("bastion:2222")+" "+authorizedKey(ca.PublicKey())+"\n")
+	cb, err = (&HostKeyPin{KnownHosts: knownCAs}).callback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("bastion:2222", remote, newHostCertSigner(t, ca, "bastion").PublicKey()); err != nil {
+		t.Errorf("certificate signed by a known_hosts CA: callback() = %v, expected nil", err)
+	}
+	if err := cb("bastion:2222", remote, newHostCertSigner(t, otherCA, "bastion").PublicKey()); !errors.Is(err, hostKeyMismatchError) {
+		t.Errorf("certificate signed by another CA: callback() = %v, expected %v", err, hostKeyMismatchError)
+	}
+
+	if cb, _ := (*HostKeyPin)(nil).callback(); cb("bastion:22", remote, other) != nil {
+		t.Error("hop without a pin rejected a host key")
+	}
+}
+
+func TestEndToEndHostKeyPin(t *testing.T) {
+	sshtest.UseAgent(t)
+	target := sshtest.NewEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	ca := sshtest.NewSigner(t)
+
+	pinned := sshtest.NewServer(t)
+	certified := sshtest.NewServer(t, sshtest.WithHostKey(newHostCertSigner(t, ca, "127.0.0.1")))
+	impostor := sshtest.NewServer(t)
+
+	addr := startProxs(t, sshHost("pinned", pinned, "")+sshHost("certified", certified, "")+sshHost("impostor", impostor, ""), `
+[proxy.pinned]
+host = "pinned"
+target_addrs = ["127.0.0.1"]
+host_key = { fingerprints = ["`+ssh.FingerprintSHA256(pinned.HostKey)+`"] }
+
+[proxy.certified]
+host = "certified"
+target_addrs = ["localhost"]
+host_key = { cas = ["`+authorizedKey(ca.PublicKey())+`"] }
+
+[proxy.impostor]
+host = "impostor"
+target_addrs = ["127.0.0.2"]
+host_key = { fingerprints = ["`+ssh.FingerprintSHA256(pinned.HostKey)+`"] }
+`)
+
+	for _, dest := range []string{target, net.JoinHostPort("localhost", port)} {
+		conn, err := socksDial(t, addr, dest)
+		if err != nil {
+			t.Fatalf("dial to %s through a trusted host: %v", dest, err)
+		}
+		if got := echo(t, conn, "hello"); got != "hello" {
+			t.Errorf("echoed %q, expected %q", got, "hello")
+		}
+		conn.Close()
+	}
+
+	if _, err := socksDial(t, addr, net.JoinHostPort("127.0.0.2", port)); err == nil || !strings.Contains(err.Error(), "general SOCKS server failure") {
+		t.Errorf("dial through a host with an unpinned key: error = %v, expected general failure", err)
+	}
+	if forwarded := impostor.Forwarded(); len(forwarded) != 0 {
+		t.Errorf("host with an unpinned key was asked to forward to %v", forwarded)
+	}
+}
+
+func TestEndToEndHostKeyPinJumpHost(t *testing.T) {
+	sshtest.UseAgent(t)
+	target := sshtest.NewEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	bastion := sshtest.NewServer(t)
+	impostor := sshtest.NewServer(t)
+	proxyHost := sshtest.NewServer(t)
+
+	addr := startProxs(t, sshHost("bastion", bastion, "")+sshHost("impostor", impostor, "")+
+		sshHost("trusted", proxyHost, "bastion")+sshHost("untrusted", proxyHost, "impostor"), `
+[proxy.trusted]
+host = "trusted"
+target_addrs = ["127.0.0.1"]
+host_key = { fingerprints = ["`+ssh.FingerprintSHA256(bastion.HostKey)+`", "`+ssh.FingerprintSHA256(proxyHost.HostKey)+`"] }
+
+[proxy.untrusted]
+host = "untrusted"
+target_addrs = ["localhost"]
+host_key = { fingerprints = ["`+ssh.FingerprintSHA256(bastion.HostKey)+`", "`+ssh.FingerprintSHA256(proxyHost.HostKey)+`"] }
+`)
+
+	conn, err := socksDial(t, addr, target)
+	if err != nil {
+		t.Fatalf("dial through a trusted jump host: %v", err)
+	}
+	if got := echo(t, conn, "hello"); got != "hello" {
+		t.Errorf("echoed %q, expected %q", got, "hello")
+	}
+	conn.Close()
+
+	if _, err := socksDial(t, addr, net.JoinHostPort("localhost", port)); err == nil || !strings.Contains(err.Error(), "general SOCKS server failure") {
+		t.Errorf("dial through a jump host with an unpinned key: error = %v, expected general failure", err)
+	}
+	if forwarded := impostor.Forwarded(); len(forwarded) != 0 {
+		t.Errorf("jump host with an unpinned key was asked to forward to %v", forwarded)
+	}
+}
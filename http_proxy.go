@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+var httpMethodNotAllowedError = errors.New("only CONNECT is supported")
+var authenticationFailedError = errors.New("authentication failed")
+var invalidConnectTargetError = errors.New("invalid CONNECT target")
+
+// httpConnect handles an HTTP proxy handshake. Only the CONNECT method is
+// supported; plain HTTP requests would require proxs to rewrite them. The
+// request is answered by writeHTTPReply once the destination has been
+// dialed.
+func httpConnect(ctx context.Context, src net.Conn, users map[string]string) (_ clientRequest, err error) {
+	defer func() { metrics.recordHandshake(protocolHTTP, err) }()
+	defer abortOnDone(ctx, src)()
+
+	req, err := http.ReadRequest(readerFor(src))
+	if err != nil {
+		slog.DebugContext(ctx, "Failed to parse HTTP request", "error", err)
+		return clientRequest{}, err
+	}
+
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(src, http.StatusMethodNotAllowed, "Allow: CONNECT\r\n")
+		return clientRequest{}, httpMethodNotAllowedError
+	}
+
+	var user string
+	if len(users) > 0 {
+		var password string
+		var ok bool
+		user, password, ok = parseProxyAuthorization(req)
+		if !ok || !checkPassword(users, user, password) {
+			writeHTTPStatus(src, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"proxs\"\r\n")
+			return clientRequest{}, authenticationFailedError
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		writeHTTPStatus(src, http.StatusBadRequest, "")
+		return clientRequest{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		writeHTTPStatus(src, http.StatusBadRequest, "")
+		return clientRequest{}, err
+	}
+	if host == "" || port == 0 {
+		writeHTTPStatus(src, http.StatusBadRequest, "")
+		return clientRequest{}, fmt.Errorf("%w: %q", invalidConnectTargetError, req.Host)
+	}
+
+	slog.DebugContext(ctx, "Received HTTP CONNECT request", "host", host, "port", port)
+
+	return clientRequest{Protocol: protocolHTTP, Host: host, Port: uint16(port), User: user}, nil
+}
+
+// writeHTTPReply answers a CONNECT request with the status for err, which
+// is nil when the destination was dialed.
+func writeHTTPReply(w io.Writer, err error) error {
+	code := http.StatusOK
+	switch {
+	case err == nil:
+	case errors.Is(err, noMatchingProxyError), errors.Is(err, destinationDeniedError):
+		code = http.StatusForbidden
+	case errors.Is(err, proxyDownError), errors.Is(err, streamLimitError):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		code = http.StatusGatewayTimeout
+	default:
+		code = http.StatusBadGateway
+	}
+	return writeHTTPStatus(w, code, "")
+}
+
+func parseProxyAuthorization(req *http.Request) (user, password string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	// http.Request.BasicAuth only looks at the Authorization header, so
+	// reuse it on a request carrying the proxy credentials instead.
+	r := http.Request{Header: http.Header{"Authorization": {auth}}}
+	return r.BasicAuth()
+}
+
+func writeHTTPStatus(w io.Writer, code int, header string) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%s\r\n", code, http.StatusText(code), header)
+	return err
+}
+
+// checkPassword reports whether password is valid for user. The comparison
+// runs in constant time so that it does not leak how much of it matched.
+func checkPassword(users map[string]string, user, password string) bool {
+	want, ok := users[user]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTPConnect(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+	basic := func(user, password string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)) + "\r\n"
+	}
+
+	tests := []struct {
+		name         string
+		users        map[string]string
+		request      string
+		expectedCode int
+		expected     clientRequest
+		wantErr      bool
+	}{
+		{
+			name:         "Valid CONNECT",
+			request:      "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			expectedCode: http.StatusOK,
+			expected:     clientRequest{Protocol: protocolHTTP, Host: "example.com", Port: 443},
+		},
+		{
+			name:         "Not CONNECT",
+			request:      "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			expectedCode: http.StatusMethodNotAllowed,
+			wantErr:      true,
+		},
+		{
+			name:         "Missing host",
+			request:      "CONNECT :443 HTTP/1.1\r\nHost: :443\r\n\r\n",
+			expectedCode: http.StatusBadRequest,
+			wantErr:      true,
+		},
+		{
+			name:         "Port zero",
+			request:      "CONNECT example.com:0 HTTP/1.1\r\nHost: example.com:0\r\n\r\n",
+			expectedCode: http.StatusBadRequest,
+			wantErr:      true,
+		},
+		{
+			name:         "Missing credentials",
+			users:        users,
+			request:      "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			expectedCode: http.StatusProxyAuthRequired,
+			wantErr:      true,
+		},
+		{
+			name:         "Wrong credentials",
+			users:        users,
+			request:      "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n" + basic("alice", "wrong") + "\r\n",
+			expectedCode: http.StatusProxyAuthRequired,
+			wantErr:      true,
+		},
+		{
+			name:         "Valid credentials",
+			users:        users,
+			request:      "CONNECT [2001:db8::1]:22 HTTP/1.1\r\nHost: [2001:db8::1]:22\r\n" + basic("alice", "secret") + "\r\n",
+			expectedCode: http.StatusOK,
+			expected:     clientRequest{Protocol: protocolHTTP, Host: "2001:db8::1", Port: 22, User: "alice"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			type result struct {
+				req clientRequest
+				err error
+			}
+			resultChan := make(chan result, 1)
+			go func() {
+				req, err := httpConnect(context.Background(), server, tt.users)
+				if err == nil {
+					// Answer as handleConnection does once the destination is dialed.
+					req.reply(server, nil)
+				}
+				resultChan <- result{req, err}
+				server.Close()
+			}()
+
+			go client.Write([]byte(tt.request))
+
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if resp.StatusCode != tt.expectedCode {
+				t.Errorf("httpConnect() status = %d, expected %d", resp.StatusCode, tt.expectedCode)
+			}
+
+			res := <-resultChan
+			if tt.wantErr {
+				if res.err == nil {
+					t.Errorf("httpConnect() expected error, but got none")
+				}
+				return
+			}
+			if res.err != nil {
+				t.Fatalf("httpConnect() unexpected error: %v", res.err)
+			}
+			if res.req != tt.expected {
+				t.Errorf("httpConnect() = %+v, expected %+v", res.req, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNegotiateMixed(t *testing.T) {
+	lc := ListenerConfig{Protocol: protocolMixed}
+
+	for _, tt := range []struct {
+		name  string
+		input []byte
+	}{
+		{"SOCKS5", append([]byte{5, 1, 0}, createSOCKS5Request("example.com", 443)...)},
+		{"HTTP", []byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go client.Write(tt.input)
+			go func() {
+				buf := make([]byte, 512)
+				for {
+					if _, err := client.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+
+			req, err := negotiate(context.Background(), newBufferedConn(server), lc, time.Second)
+			if err != nil {
+				t.Fatalf("negotiate() unexpected error: %v", err)
+			}
+			if req.Host != "example.com" || req.Port != 443 {
+				t.Errorf("negotiate() = %+v, expected example.com:443", req)
+			}
+		})
+	}
+}
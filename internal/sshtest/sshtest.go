@@ -0,0 +1,320 @@
+// Package sshtest provides in-process SSH servers, an SSH agent and TCP
+// targets for tests that drive proxs end to end over loopback.
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Server is an SSH server that forwards direct-tcpip channels, so that it
+// can serve both as the last hop of a proxy and as a jump host.
+type Server struct {
+	Addr    *net.TCPAddr
+	HostKey ssh.PublicKey
+
+	permit func(host string, port int) bool
+	conns  atomic.Int32
+	open   atomic.Int32
+	stall  atomic.Bool
+
+	mu        sync.Mutex
+	forwarded []string
+}
+
+type options struct {
+	hostKey        ssh.Signer
+	authorizedKeys []ssh.PublicKey
+	permit         func(host string, port int) bool
+}
+
+// An Option configures a Server.
+type Option func(*options)
+
+// WithHostKey makes the server present signer as its host key instead of a
+// freshly generated one.
+func WithHostKey(signer ssh.Signer) Option {
+	return func(o *options) { o.hostKey = signer }
+}
+
+// WithAuthorizedKeys makes the server accept only clients authenticating
+// with one of keys. By default any client is accepted without
+// authentication.
+func WithAuthorizedKeys(keys ...ssh.PublicKey) Option {
+	return func(o *options) { o.authorizedKeys = append(o.authorizedKeys, keys...) }
+}
+
+// WithPermit restricts the destinations the server forwards to; the others
+// are rejected as administratively prohibited.
+func WithPermit(permit func(host string, port int) bool) Option {
+	return func(o *options) { o.permit = permit }
+}
+
+// PermitOnly allows forwarding to the given host:port addresses only, as a
+// jump host restricted to the next hop would.
+func PermitOnly(addrs ...string) Option {
+	return WithPermit(func(host string, port int) bool {
+		return slices.Contains(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	})
+}
+
+// NewServer starts a server on a loopback port, closed when the test ends.
+func NewServer(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.hostKey == nil {
+		o.hostKey = NewSigner(t)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: len(o.authorizedKeys) == 0}
+	if len(o.authorizedKeys) > 0 {
+		config.PublicKeyCallback = func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range o.authorizedKeys {
+				if ssh.FingerprintSHA256(k) == ssh.FingerprintSHA256(key) {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("public key not authorized")
+		}
+	}
+	config.AddHostKey(o.hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	srv := &Server{Addr: ln.Addr().(*net.TCPAddr), HostKey: o.hostKey.PublicKey(), permit: o.permit}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(nc, config)
+		}
+	}()
+	return srv
+}
+
+// Port returns the port the server listens on.
+func (srv *Server) Port() int { return srv.Addr.Port }
+
+// Conns returns the number of SSH connections the server has accepted.
+func (srv *Server) Conns() int { return int(srv.conns.Load()) }
+
+// Open returns the number of SSH connections still open.
+func (srv *Server) Open() int { return int(srv.open.Load()) }
+
+// Stall makes the server leave channel opens unanswered, or answer them
+// again.
+func (srv *Server) Stall(stall bool) { srv.stall.Store(stall) }
+
+// Forwarded returns the host:port of each destination the server opened a
+// channel to, in order.
+func (srv *Server) Forwarded() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return slices.Clone(srv.forwarded)
+}
+
+func (srv *Server) serve(nc net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	srv.conns.Add(1)
+	srv.open.Add(1)
+	defer srv.open.Add(-1)
+	defer conn.Close()
+
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if srv.stall.Load() {
+			continue
+		}
+		if nch.ChannelType() != "direct-tcpip" {
+			nch.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		var dest struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(nch.ExtraData(), &dest); err != nil {
+			nch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		if srv.permit != nil && !srv.permit(dest.Host, int(dest.Port)) {
+			nch.Reject(ssh.Prohibited, "destination not permitted")
+			continue
+		}
+		addr := net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port)))
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			nch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := nch.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		srv.mu.Lock()
+		srv.forwarded = append(srv.forwarded, addr)
+		srv.mu.Unlock()
+
+		go ssh.DiscardRequests(chReqs)
+		go forward(ch, target.(*net.TCPConn))
+	}
+}
+
+// forward copies between a channel and its destination, passing on the
+// end of each direction.
+func forward(ch ssh.Channel, target *net.TCPConn) {
+	defer ch.Close()
+	defer target.Close()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(target, ch)
+		target.CloseWrite()
+		close(done)
+	}()
+	io.Copy(ch, target)
+	ch.CloseWrite()
+	<-done
+}
+
+// NewSigner returns a new ed25519 key.
+func NewSigner(t testing.TB) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// UseAgent points SSH_AUTH_SOCK at an in-process agent holding one new key
+// and returns its public key.
+func UseAgent(t testing.TB) ssh.PublicKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				agent.ServeAgent(keyring, c)
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	return signer.PublicKey()
+}
+
+// NewEchoServer starts a TCP server that writes back what it reads until
+// the client half-closes, and returns its address.
+func NewEchoServer(t testing.TB) string {
+	t.Helper()
+	return serveTCP(t, func(c *net.TCPConn) {
+		io.Copy(c, c)
+		c.CloseWrite()
+	})
+}
+
+// NewSinkServer starts a TCP server that keeps the connections it accepts
+// open until the test ends, and returns its address.
+func NewSinkServer(t testing.TB) string {
+	t.Helper()
+	return serveTCP(t, func(c *net.TCPConn) {
+		io.Copy(io.Discard, c)
+	})
+}
+
+// NewHTTPServer starts an HTTP server for handler and returns its address.
+func NewHTTPServer(t testing.TB, handler http.Handler) string {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func serveTCP(t testing.TB, handle func(*net.TCPConn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			go func() {
+				defer c.Close()
+				handle(c.(*net.TCPConn))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
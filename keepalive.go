@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keepaliveCheckTimeout bounds the wait for a keepalive reply in
+// sshPool.Check, which has no ServerAliveInterval to go by.
+const keepaliveCheckTimeout = 10 * time.Second
+
+var keepaliveTimeoutError = errors.New("no reply to keepalive request")
+
+// sendKeepalive sends a keepalive@openssh.com request and waits up to
+// timeout for the reply. Servers answer the unknown request with a
+// failure, which proves the connection is alive just as well.
+func sendKeepalive(client *ssh.Client, timeout time.Duration) error {
+	reply := requestKeepalive(client)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-reply:
+		return err
+	case <-timer.C:
+		return keepaliveTimeoutError
+	}
+}
+
+// requestKeepalive sends a keepalive@openssh.com request in the background
+// and returns the channel its outcome is delivered on. The request is only
+// abandoned when client is closed.
+func requestKeepalive(client *ssh.Client) <-chan error {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	return reply
+}
+
+// startKeepAlive starts sending keepalives over client, the connection to
+// hop sc, when ServerAliveInterval is set.
+func (sc *sshConnection) startKeepAlive(client *ssh.Client) {
+	if sc.ServerAliveInterval > 0 {
+		go keepAlive(client, sc.String(), sc.ServerAliveInterval, sc.ServerAliveCountMax)
+	}
+}
+
+// keepAlive sends a keepalive request every interval, like OpenSSH's
+// ServerAliveInterval, and closes client once countMax consecutive requests
+// went unanswered; a countMax of zero never closes it. Closing a hop fails
+// every channel opened over it, including the connections to the hops
+// behind it, so the failure reaches all the streams of the chain. A new
+// request is only sent once the previous one is answered; each interval it
+// stays unanswered counts as a missed keepalive. It returns when client is
+// closed.
+func keepAlive(client *ssh.Client, hop string, interval time.Duration, countMax int) {
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var reply <-chan error // of the outstanding request, if any
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case err := <-reply:
+			if err != nil {
+				// The connection failed on its own; Wait reports it.
+				return
+			}
+			reply, missed = nil, 0
+			continue
+		case <-ticker.C:
+		}
+
+		if reply == nil {
+			reply = requestKeepalive(client)
+			continue
+		}
+		missed++
+		slog.Debug("SSH keepalive unanswered", "hop", hop, "missed", missed)
+		if countMax > 0 && missed >= countMax {
+			slog.Warn("SSH server stopped answering keepalives, closing connection", "hop", hop, "missed", missed)
+			metrics.sshKeepaliveLost.with(hop).Inc()
+			client.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newLoopbackSSHClient connects an SSH client to an in-process server that
+// answers global requests only when answer is set.
+func newLoopbackSSHClient(t *testing.T, answer bool) *ssh.Client {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	// The SSH version exchange needs buffering, which net.Pipe lacks.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		serverSide, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn, chans, reqs, err := ssh.NewServerConn(serverSide, serverConfig)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() {
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "no channels")
+			}
+		}()
+		for req := range reqs {
+			if answer {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	clientSide, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(clientSide, ln.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestKeepAlive(t *testing.T) {
+	tests := []struct {
+		name     string
+		answer   bool
+		countMax int
+		closed   bool
+	}{
+		{"answered", true, 2, false},
+		{"unanswered", false, 2, true},
+		{"unanswered without count", false, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newLoopbackSSHClient(t, tt.answer)
+			done := make(chan struct{})
+			go func() {
+				keepAlive(client, "test@loopback:22", 10*time.Millisecond, tt.countMax)
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				if !tt.closed {
+					t.Fatal("keepAlive() returned while the connection was healthy")
+				}
+				if err := sendKeepalive(client, time.Second); err == nil {
+					t.Error("expected the connection to be closed")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.closed {
+					t.Fatal("keepAlive() did not close the unresponsive connection")
+				}
+				client.Close()
+				<-done
+			}
+		})
+	}
+}
+
+func TestKeepAliveOneOutstandingRequest(t *testing.T) {
+	client := newLoopbackSSHClient(t, false)
+	before := runtime.NumGoroutine()
+	done := make(chan struct{})
+	go func() {
+		keepAlive(client, "test@loopback:22", time.Millisecond, 0)
+		close(done)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if n := runtime.NumGoroutine() - before; n > 5 {
+		t.Errorf("%d goroutines started by keepAlive() to an unresponsive server, expected one request at a time", n)
+	}
+	client.Close()
+	<-done
+}
+
+func TestSendKeepaliveTimeout(t *testing.T) {
+	client := newLoopbackSSHClient(t, false)
+	if err := sendKeepalive(client, 10*time.Millisecond); err != keepaliveTimeoutError {
+		t.Errorf("sendKeepalive() = %v, expected %v", err, keepaliveTimeoutError)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	protocolSOCKS5 = "socks5"
+	protocolHTTP   = "http"
+	protocolMixed  = "mixed"
+)
+
+// ListenerConfig describes one socket proxs accepts clients on. Either
+// Address/Port or Socket is set; Users and Proxies are optional and restrict
+// who may use the listener and which proxies it routes through. AllowClients
+// restricts the source addresses of TCP clients, and Access, with Groups,
+// the proxies and routes each user may use. Name matches the
+// FileDescriptorName of a systemd socket to use instead of listening.
+type ListenerConfig struct {
+	Name         string              `toml:"name"`
+	Address      string              `toml:"address"`
+	Port         int                 `toml:"port"`
+	Socket       string              `toml:"socket"`
+	SocketMode   string              `toml:"socket_mode"`
+	Protocol     string              `toml:"protocol"`
+	Users        map[string]string   `toml:"users"`
+	Proxies      []string            `toml:"proxies"`
+	AllowClients []string            `toml:"allow_clients"`
+	Groups       map[string][]string `toml:"groups"`
+	Access       map[string][]string `toml:"access"`
+}
+
+func (lc ListenerConfig) Network() string {
+	if lc.Socket != "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+func (lc ListenerConfig) Addr() string {
+	if lc.Socket != "" {
+		return lc.Socket
+	}
+	return net.JoinHostPort(lc.Address, strconv.Itoa(lc.Port))
+}
+
+// parseListenAddr parses the argument of `proxs run --listen`: a
+// host:port pair or the path of a Unix socket.
+func parseListenAddr(addr string) (ListenerConfig, error) {
+	if strings.Contains(addr, "/") {
+		return ListenerConfig{Socket: addr, Protocol: protocolSOCKS5}, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ListenerConfig{}, fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return ListenerConfig{}, fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return ListenerConfig{Address: host, Port: port, Protocol: protocolSOCKS5}, nil
+}
+
+// LogValue keeps the passwords of a listener out of the logs.
+func (lc ListenerConfig) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("name", lc.Name),
+		slog.String("address", lc.Addr()),
+		slog.String("protocol", lc.Protocol),
+		slog.Any("user_names", slices.Sorted(maps.Keys(lc.Users))),
+		slog.Any("proxies", lc.Proxies),
+		slog.Any("allow_clients", lc.AllowClients),
+	)
+}
+
+// key identifies the socket of a listener across configuration reloads.
+func (lc ListenerConfig) key() string {
+	return lc.Name + "|" + lc.Network() + "|" + lc.Addr()
+}
+
+func (lc ListenerConfig) validate(proxies map[string]sshProxy) error {
+	if lc.Socket == "" {
+		// A named listener may leave its port out when its socket is
+		// always passed by systemd.
+		if (lc.Port != 0 || lc.Name == "") && (lc.Port <= 0 || lc.Port > 65535) {
+			return fmt.Errorf("listener %s: invalid port %d", lc.Addr(), lc.Port)
+		}
+		if lc.Address != "" && net.ParseIP(lc.Address) == nil {
+			return fmt.Errorf("listener %s: address must be an IP address", lc.Addr())
+		}
+	} else if lc.Address != "" || lc.Port != 0 {
+		return fmt.Errorf("listener %s: socket cannot be combined with address or port", lc.Socket)
+	}
+
+	if _, err := lc.socketMode(); err != nil {
+		return fmt.Errorf("listener %s: %w", lc.Addr(), err)
+	}
+
+	switch lc.Protocol {
+	case protocolSOCKS5, protocolHTTP, protocolMixed:
+	default:
+		return fmt.Errorf("listener %s: unknown protocol %q", lc.Addr(), lc.Protocol)
+	}
+
+	for _, name := range lc.Proxies {
+		if _, ok := proxies[name]; !ok {
+			return fmt.Errorf("listener %s: unknown proxy %q", lc.Addr(), name)
+		}
+	}
+
+	if err := lc.validateClients(); err != nil {
+		return fmt.Errorf("listener %s: %w", lc.Addr(), err)
+	}
+	if err := lc.validateAccess(proxies); err != nil {
+		return fmt.Errorf("listener %s: %w", lc.Addr(), err)
+	}
+	return nil
+}
+
+// socketMode returns the permissions applied to a Unix socket listener.
+// Sockets default to 0600 so that only the owner can reach an
+// unauthenticated proxy.
+func (lc ListenerConfig) socketMode() (fs.FileMode, error) {
+	if lc.SocketMode == "" {
+		return 0o600, nil
+	}
+	mode, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid socket_mode %q", lc.SocketMode)
+	}
+	return fs.FileMode(mode), nil
+}
+
+func listen(lc ListenerConfig) (net.Listener, error) {
+	if lc.Socket == "" {
+		return net.Listen(lc.Network(), lc.Addr())
+	}
+
+	// A socket file left behind by a previous run would make Listen fail
+	// with "address already in use".
+	if fi, err := os.Lstat(lc.Socket); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(lc.Socket); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen(lc.Network(), lc.Addr())
+	if err != nil {
+		return nil, err
+	}
+	mode, _ := lc.socketMode()
+	if err := os.Chmod(lc.Socket, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// boundListener is an open socket together with the configuration it
+// serves.
+type boundListener struct {
+	net.Listener
+	cfg ListenerConfig
+}
+
+// openListeners opens a socket for every configured listener. A socket
+// passed by systemd is used instead of listening when its
+// FileDescriptorName matches the listener name; a config without
+// [[listener]] tables serves every passed socket as the default listener.
+func openListeners(cfg *Config, inherited map[string][]net.Listener) ([]boundListener, error) {
+	var bound []boundListener
+	closeAll := func() {
+		for _, bl := range bound {
+			bl.Close()
+		}
+		for _, lns := range inherited {
+			for _, ln := range lns {
+				ln.Close()
+			}
+		}
+	}
+
+	listeners := cfg.listeners()
+	if len(cfg.Listeners) == 0 && len(inherited) == 0 && cfg.ListenPort == 0 {
+		return nil, fmt.Errorf("no port or [[listener]] configured, and no socket passed by systemd")
+	}
+	if len(cfg.Listeners) == 0 && len(inherited) > 0 {
+		for _, lns := range inherited {
+			for _, ln := range lns {
+				bound = append(bound, boundListener{ln, listeners[0]})
+			}
+		}
+		return bound, nil
+	}
+
+	for _, lc := range listeners {
+		if lns, ok := inherited[lc.Name]; ok && lc.Name != "" {
+			for _, ln := range lns {
+				bound = append(bound, boundListener{ln, lc})
+			}
+			delete(inherited, lc.Name)
+			continue
+		}
+		if lc.Name != "" && lc.Socket == "" && lc.Port == 0 {
+			closeAll()
+			return nil, fmt.Errorf("listener %s: no socket passed by systemd, and no port or socket configured", lc.Name)
+		}
+
+		ln, err := listen(lc)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to listen on %s: %w", lc.Addr(), err)
+		}
+		bound = append(bound, boundListener{ln, lc})
+	}
+
+	for name, lns := range inherited {
+		slog.Warn("Ignoring systemd socket without matching listener", "name", name)
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+	return bound, nil
+}
+
+// clientRequest is the destination requested by a client, independent of
+// the proxy protocol it was received with.
+type clientRequest struct {
+	Protocol string
+	Host     string
+	Port     uint16
+	User     string
+}
+
+// Addr returns the requested destination as host:port.
+func (r clientRequest) Addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+}
+
+// reply answers the request on w with the outcome of routing and dialing
+// it; err is nil on success.
+func (r clientRequest) reply(w io.Writer, err error) error {
+	if r.Protocol == protocolHTTP {
+		return writeHTTPReply(w, err)
+	}
+	return writeSocksReply(w, err)
+}
+
+// negotiate runs the handshake of the listener's protocol, giving up after
+// timeout. For mixed listeners the first byte decides: SOCKS5 greetings
+// start with 0x05, while an HTTP request line starts with a printable
+// method name.
+func negotiate(ctx context.Context, src net.Conn, lc ListenerConfig, timeout time.Duration) (clientRequest, error) {
+	ctx, cancel, timedOut := withTimeout(ctx, timeout, handshakeTimeoutError)
+	defer cancel()
+
+	protocol := lc.Protocol
+	if protocol == protocolMixed {
+		stop := abortOnDone(ctx, src)
+		first, err := readerFor(src).Peek(1)
+		stop()
+		if err != nil {
+			return clientRequest{}, timedOut(err)
+		}
+		protocol = protocolHTTP
+		if first[0] == 5 {
+			protocol = protocolSOCKS5
+		}
+	}
+
+	var req clientRequest
+	var err error
+	switch protocol {
+	case protocolHTTP:
+		req, err = httpConnect(ctx, src, lc.Users)
+	default:
+		req, err = socksConnection(ctx, src, lc.Users)
+	}
+	return req, timedOut(err)
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader, so that
+// bytes peeked or read ahead during the handshake are not lost to the relay.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(c net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection, if it supports it.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// abortOnDone makes blocked reads and writes on conn fail once ctx is done.
+// The returned function stops watching ctx. When ctx was done already, it
+// clears the deadline again, so that a handshake completing just as ctx is
+// done does not hand a connection that fails at once to the relay.
+func abortOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	aborted := make(chan struct{})
+	stopWatching := context.AfterFunc(ctx, func() {
+		defer close(aborted)
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		if !stopWatching() {
+			<-aborted
+			conn.SetDeadline(time.Time{})
+		}
+	}
+}
+
+func readerFor(c net.Conn) *bufio.Reader {
+	if bc, ok := c.(*bufferedConn); ok {
+		return bc.r
+	}
+	return bufio.NewReader(c)
+}
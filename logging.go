@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// LogConfig configures the diagnostic log. Records go to stderr unless
+// File is set.
+type LogConfig struct {
+	Level  string `toml:"level"`
+	Format string `toml:"format"`
+	File   string `toml:"file"`
+}
+
+func (lc LogConfig) validate() error {
+	if lc.Level != "" {
+		if _, err := parseLogLevel(lc.Level); err != nil {
+			return err
+		}
+	}
+	switch lc.Format {
+	case "", logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("log: unknown format %q", lc.Format)
+	}
+	return nil
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+// logLevel is the level of the installed handler. It can be changed on
+// reload without replacing the handler.
+var logLevel slog.LevelVar
+
+// setupLogging installs the handler described by lc as the default logger,
+// which also receives the output of the standard log package. A non-empty
+// levelOverride, from the command line, takes precedence over lc.Level.
+// The returned closer closes the log file, if any.
+func setupLogging(lc LogConfig, levelOverride string) (io.Closer, error) {
+	if err := lc.validate(); err != nil {
+		return nil, err
+	}
+	if err := applyLogLevel(lc, levelOverride); err != nil {
+		return nil, err
+	}
+
+	var w io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(os.Stderr)
+	if lc.File != "" {
+		f, err := os.OpenFile(lc.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f
+	}
+
+	slog.SetDefault(slog.New(newLogHandler(w, lc.Format, &logLevel)))
+	return closer, nil
+}
+
+// applyLogLevel sets the level of the installed handler.
+func applyLogLevel(lc LogConfig, levelOverride string) error {
+	s := levelOverride
+	if s == "" {
+		s = lc.Level
+	}
+	if s == "" {
+		logLevel.Set(slog.LevelInfo)
+		return nil
+	}
+	level, err := parseLogLevel(s)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+func newLogHandler(w io.Writer, format string, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	if format == logFormatJSON {
+		return contextHandler{slog.NewJSONHandler(w, opts)}
+	}
+	return contextHandler{slog.NewTextHandler(w, opts)}
+}
+
+// sensitiveLogKeys are attribute keys whose values never appear in logs.
+var sensitiveLogKeys = []string{"password", "passwd", "secret", "token", "authorization", "users"}
+
+const redacted = "[REDACTED]"
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if slices.Contains(sensitiveLogKeys, strings.ToLower(a.Key)) {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log records carry attrs in addition
+// to those already attached to ctx.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	return context.WithValue(ctx, logAttrsKey{}, append(slices.Clip(prev), attrs...))
+}
+
+// contextHandler adds the attributes attached to the context of a record
+// with withLogAttrs, such as the ID and address of the client connection
+// the record is about.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
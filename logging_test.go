@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogHandlerConnectionAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, logFormatJSON, slog.LevelDebug))
+
+	ctx := withLogAttrs(context.Background(), slog.Uint64("conn_id", 7), slog.String("client", "127.0.0.1:50000"))
+	ctx = withLogAttrs(ctx, slog.String("proxy", "env1"))
+	logger.InfoContext(ctx, "Routing connection", "destination", "db.internal:5432")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid JSON record %q: %v", buf.String(), err)
+	}
+	for key, want := range map[string]any{
+		"msg":         "Routing connection",
+		"conn_id":     float64(7),
+		"client":      "127.0.0.1:50000",
+		"proxy":       "env1",
+		"destination": "db.internal:5432",
+	} {
+		if record[key] != want {
+			t.Errorf("record[%q] = %v, expected %v", key, record[key], want)
+		}
+	}
+}
+
+func TestLogHandlerRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, logFormatText, slog.LevelDebug))
+
+	lc := ListenerConfig{Address: "127.0.0.1", Port: 1080, Protocol: protocolSOCKS5, Users: map[string]string{"alice": "s3cret"}}
+	logger.Info("Listener", "listener", lc, "password", "hunter2", "Authorization", "Basic YWxpY2U6czNjcmV0")
+
+	out := buf.String()
+	for _, secret := range []string{"s3cret", "hunter2", "YWxpY2U6czNjcmV0"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log output %q contains secret %q", out, secret)
+		}
+	}
+	if !strings.Contains(out, "alice") {
+		t.Errorf("log output %q should still name the listener's users", out)
+	}
+}
+
+func TestLogHandlerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	var level slog.LevelVar
+	level.Set(slog.LevelWarn)
+	logger := slog.New(newLogHandler(&buf, logFormatText, &level))
+
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "shown") {
+		t.Errorf("unexpected output at warn level: %q", out)
+	}
+}
+
+func TestLogConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		lc      LogConfig
+		wantErr bool
+	}{
+		{LogConfig{}, false},
+		{LogConfig{Level: "debug", Format: logFormatJSON}, false},
+		{LogConfig{Level: "verbose"}, true},
+		{LogConfig{Format: "xml"}, true},
+	} {
+		if err := tt.lc.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) = %v, wantErr %v", tt.lc, err, tt.wantErr)
+		}
+	}
+}
@@ -1,84 +1,227 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"log"
 	"log/slog"
-	"maps"
 	"net"
-	"slices"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-func handleConnection(src net.Conn, proxies []sshProxy, cfg *Config) {
+// handleConnection proxies one client connection and records its progress
+// in sess. Cancelling ctx aborts the handshake, the dial and the relay.
+func handleConnection(ctx context.Context, sess *session, conn net.Conn, cfg *Config, lc ListenerConfig) {
+	src := newBufferedConn(conn)
 	defer src.Close()
 
-	destAddr, destPort, err := socksConnection(src, cfg)
+	proxies := cfg.proxiesFor(lc)
+	timeouts := cfg.Timeouts
+
+	if timeouts.MaxLifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeouts.MaxLifetime, sessionExpiredError)
+		defer cancel()
+	}
+
+	req, err := negotiate(ctx, src, lc, timeouts.handshake())
 	if err != nil {
-		log.Printf("Failed to establish SOCKS connection: %v", err)
+		sess.setCloseReason(closeHandshakeFailed)
+		slog.WarnContext(ctx, "Handshake failed", "protocol", lc.Protocol, "error", err)
 		return
 	}
+	sess.setRequest(req)
 
-	sp, err := sshProxySelectFrom(destAddr, proxies)
+	sp, rule, err := sshProxyRouteFrom(ctx, req.Host, proxies)
 	if err != nil {
-		log.Printf("Failed to select SSH proxy: %v", err)
+		sess.setCloseReason(closeNoRoute)
+		req.reply(src, err)
+		metrics.routeDecisions.with("none").Inc()
+		slog.WarnContext(ctx, "Failed to select SSH proxy", "destination", req.Addr(), "user", req.User, "error", err)
 		return
 	}
+	metrics.routeDecisions.with(sp.Name).Inc()
+	sess.setRoute(sp, rule)
 
-	// Create SSH connection to the last jump host in the chain
-	sshProxyClient, cleanup, err := sp.Connection.Dial("tcp", net.JoinHostPort(destAddr, fmt.Sprintf("%d", destPort)))
-	if err != nil {
-		slog.Error("Failed to create destination connection", "address", destAddr, "port", destPort, "error", err)
+	if err := lc.checkAccess(req.User, sp, rule); err != nil {
+		sess.setCloseReason(closeDenied)
+		req.reply(src, err)
+		metrics.destinationsDenied.with(sp.Name).Inc()
+		slog.WarnContext(ctx, "Destination denied", "destination", req.Addr(), "user", req.User, "proxy", sp.Name, "rule", rule, "reason", err)
 		return
 	}
-	defer cleanup()
+	if err := cfg.checkDestination(sp, req.Host, req.Port); err != nil {
+		sess.setCloseReason(closeDenied)
+		req.reply(src, err)
+		metrics.destinationsDenied.with(sp.Name).Inc()
+		slog.WarnContext(ctx, "Destination denied", "destination", req.Addr(), "user", req.User, "proxy", sp.Name, "rule", rule, "reason", err)
+		return
+	}
+	slog.InfoContext(ctx, "Routing connection", "destination", req.Addr(), "user", req.User, "proxy", sp.Name, "rule", rule)
 
-	// Create a connection to the destination address over the SSH proxy
-	dst, err := sshProxyClient.Dial("tcp", net.JoinHostPort(destAddr, fmt.Sprintf("%d", destPort)))
+	// Open a channel to the destination over the proxy's shared SSH connection
+	dst, err := sp.pool.Dial(ctx, "tcp", req.Addr())
 	if err != nil {
-		slog.Error("Failed to create destination connection over SSH", "address", destAddr, "port", destPort, "error", err)
+		sess.setCloseReason(closeDialFailed)
+		req.reply(src, err)
+		slog.ErrorContext(ctx, "Failed to create destination connection over SSH", "destination", req.Addr(), "proxy", sp.Name, "error", err)
 		return
 	}
 
 	defer dst.Close()
+	if pc, ok := dst.(*poolConn); ok {
+		sess.setChain(pc.chain())
+	}
 
-	go func() {
-		_, err := io.Copy(dst, src)
-		if err != nil {
-			log.Printf("Error copying from src to dst: %v", err)
-		}
+	if err := req.reply(src, nil); err != nil {
+		sess.setCloseReason(closeClient)
+		slog.DebugContext(ctx, "Failed to send reply", "error", err)
+		return
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		sess.setCloseReason(closeReasonFor(context.Cause(ctx)))
+		src.Close()
 		dst.Close()
-	}()
-	_, err = io.Copy(src, dst)
-	if err != nil {
-		log.Printf("Error copying from dst to src: %v", err)
+	})
+	defer stop()
+
+	if timeouts.Idle > 0 {
+		go sess.watchIdle(ctx, timeouts.Idle)
 	}
+
+	up, down, release := cfg.shapersFor(sess.Client, sp, rule, req.Port)
+	defer release()
+	relay(ctx, sess, src, dst, sp.Name, cfg.Relay.bufferSize(), up, down)
 }
 
 func main() {
-	var listenAddr string
+	os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+}
 
-	cfg, err := LoadConfig()
+// runOptions are the command-line settings of `proxs run`.
+type runOptions struct {
+	ConfigPath string
+	Listen     []string
+	LogLevel   string
+}
+
+// loadConfig loads the configuration file and applies the command-line
+// overrides on top of it. It is used both at startup and on reload.
+func (opts runOptions) loadConfig() (*Config, error) {
+	cfg, err := LoadConfigFile(opts.ConfigPath)
 	if err != nil {
-		slog.Error("Failed to load configuration", "error", err)
-		return
+		return nil, err
 	}
-	listenAddr = net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", cfg.ListenPort))
+	if len(opts.Listen) == 0 {
+		return cfg, nil
+	}
+
+	cfg.Listeners = nil
+	for _, addr := range opts.Listen {
+		lc, err := parseListenAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := lc.validate(cfg.Proxies); err != nil {
+			return nil, err
+		}
+		cfg.Listeners = append(cfg.Listeners, lc)
+	}
+	return cfg, nil
+}
 
-	ln, err := net.Listen("tcp", listenAddr)
+// run serves proxy clients until SIGINT or SIGTERM.
+func run(opts runOptions) error {
+	cfg, err := opts.loadConfig()
 	if err != nil {
-		slog.Error("Failed to listen on address", "address", listenAddr, "error", err)
-		return
+		return fmt.Errorf("failed to load configuration: %w", err)
 	}
 
-	proxies := slices.Collect(maps.Values(cfg.Proxies))
+	logFile, err := setupLogging(cfg.Log, opts.LogLevel)
+	if err != nil {
+		return fmt.Errorf("failed to set up logging: %w", err)
+	}
+	defer logFile.Close()
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			slog.Warn("Failed to accept connection", "error", err)
-			continue
+	var accessLog *accessLogger
+	if cfg.AccessLog.enabled() {
+		if accessLog, err = openAccessLog(cfg.AccessLog); err != nil {
+			return fmt.Errorf("failed to open access log: %w", err)
+		}
+	}
+
+	inherited, err := systemdListeners()
+	if err != nil {
+		return fmt.Errorf("failed to use sockets passed by systemd: %w", err)
+	}
+	listeners, err := openListeners(cfg, inherited)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := newServer(cfg, listeners)
+	srv.load = opts.loadConfig
+	srv.logLevelOverride = opts.LogLevel
+	srv.accessLog = accessLog
+	srv.Serve()
+
+	if cfg.Admin.enabled() {
+		if err := srv.ServeAdmin(cfg.Admin); err != nil {
+			srv.Shutdown(0)
+			return fmt.Errorf("failed to start admin endpoint: %w", err)
 		}
-		go handleConnection(conn, proxies, cfg)
 	}
+	if cfg.Metrics.Address != "" {
+		if err := srv.ServeMetrics(cfg.Metrics); err != nil {
+			srv.Shutdown(0)
+			return fmt.Errorf("failed to start metrics endpoint: %w", err)
+		}
+	}
+
+	go runWatchdog(ctx, sdWatchdogInterval(), srv.pools)
+
+	// Reload on SIGHUP and whenever the configuration files change.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	watched := func() []string {
+		return append([]string{opts.ConfigPath}, sshConfigFiles(sshConfigPath())...)
+	}
+	go watchFiles(ctx, watched, configPollInterval, func() {
+		select {
+		case reload <- syscall.SIGHUP:
+		default: // A reload is already pending.
+		}
+	})
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reload:
+				srv.Reload()
+			}
+		}
+	}()
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+
+	<-ctx.Done()
+	// Restore the default signal behaviour, so that a second signal kills
+	// proxs without waiting for connections to drain.
+	stop()
+
+	timeout := srv.config().ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	slog.Info("Shutting down", "timeout", timeout)
+	sdNotify("STOPPING=1")
+	srv.Shutdown(timeout)
+	return nil
 }
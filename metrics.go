@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MetricsConfig enables a dedicated listener for the Prometheus /metrics
+// endpoint. Metrics are also served by the admin endpoint; a separate
+// listener lets them be scraped without exposing the admin actions.
+type MetricsConfig struct {
+	Address string `toml:"address"`
+}
+
+// proxsMetrics are the metrics exported by proxs.
+type proxsMetrics struct {
+	registry registry
+
+	handshakes         *metric
+	routeDecisions     *metric
+	sshDialDuration    *metric
+	channelOpenFails   *metric
+	activeStreams      *metric
+	bytes              *metric
+	sshReconnects      *metric
+	sshKeepaliveLost   *metric
+	clientsRejected    *metric
+	destinationsDenied *metric
+}
+
+var metrics = newProxsMetrics()
+
+func newProxsMetrics() *proxsMetrics {
+	m := &proxsMetrics{}
+	r := &m.registry
+	m.handshakes = r.newMetric("proxs_handshakes_total", "Client handshakes by protocol and outcome.", "counter", nil, "protocol", "outcome")
+	m.routeDecisions = r.newMetric("proxs_route_decisions_total", "Destinations routed to each proxy; \"none\" when no proxy matched.", "counter", nil, "proxy")
+	m.sshDialDuration = r.newMetric("proxs_ssh_dial_duration_seconds", "Time to connect and authenticate to each SSH hop.", "histogram",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "hop", "outcome")
+	m.channelOpenFails = r.newMetric("proxs_ssh_channel_open_failures_total", "Failures to open a direct-tcpip channel by reason.", "counter", nil, "proxy", "reason")
+	m.activeStreams = r.newMetric("proxs_active_streams", "Streams currently open through each proxy.", "gauge", nil, "proxy")
+	m.bytes = r.newMetric("proxs_bytes_total", "Bytes relayed through each proxy; out is client to destination.", "counter", nil, "proxy", "direction")
+	m.sshReconnects = r.newMetric("proxs_ssh_reconnects_total", "SSH connections of each proxy dialed again after the first one.", "counter", nil, "proxy")
+	m.sshKeepaliveLost = r.newMetric("proxs_ssh_keepalive_timeouts_total", "SSH connections closed after the server stopped answering keepalives.", "counter", nil, "hop")
+	m.destinationsDenied = r.newMetric("proxs_destinations_denied_total", "Connections refused by an ACL, by the proxy they were routed to.", "counter", nil, "proxy")
+	m.clientsRejected = r.newMetric("proxs_clients_rejected_total", "Client connections closed without being handled because max_clients was reached.", "counter", nil, "reason")
+	r.newMetric("proxs_build_info", "Version of the running proxs binary.", "gauge", nil, "version").with(version()).Set(1)
+	return m
+}
+
+// recordHandshake counts the outcome of a client handshake.
+func (m *proxsMetrics) recordHandshake(protocol string, err error) {
+	outcome := "success"
+	switch {
+	case errors.Is(err, authenticationFailedError):
+		outcome = "auth_failed"
+	case err != nil:
+		outcome = "error"
+	}
+	m.handshakes.with(protocol, outcome).Inc()
+}
+
+// recordChannelOpenFailure counts a failure to open a channel, labelled
+// with the reason given by the server when there is one.
+func (m *proxsMetrics) recordChannelOpenFailure(proxy string, err error) {
+	reason := "error"
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		reason = strings.ReplaceAll(openErr.Reason.String(), " ", "_")
+	}
+	m.channelOpenFails.with(proxy, reason).Inc()
+}
+
+func (m *proxsMetrics) observeSSHDial(hop string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	m.sshDialDuration.with(hop, outcome).Observe(time.Since(start).Seconds())
+}
+
+func (m *proxsMetrics) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := m.registry.WriteTo(w); err != nil {
+			slog.Warn("Failed to write metrics", "error", err)
+		}
+	})
+}
+
+// ServeMetrics starts the dedicated metrics listener. It is stopped by
+// Shutdown.
+func (s *server) ServeMetrics(mc MetricsConfig) error {
+	ln, err := net.Listen("tcp", mc.Address)
+	if err != nil {
+		return err
+	}
+	slog.Info("Metrics endpoint listening", "address", ln.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.handler())
+	s.metrics = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.metrics.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics endpoint stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// registry is a minimal Prometheus registry producing the text exposition
+// format, which is all proxs needs from a client library.
+type registry struct {
+	metrics []*metric
+}
+
+func (r *registry) newMetric(name, help, kind string, buckets []float64, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *registry) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	for _, m := range r.metrics {
+		m.writeTo(bw)
+	}
+	return 0, bw.Flush()
+}
+
+// metric is a counter, gauge or histogram partitioned by label values.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// with returns the series for the given label values, creating it on
+// first use.
+func (m *metric) with(values ...string) *series {
+	key := strings.Join(values, "\xff")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: values}
+		if m.kind == "histogram" {
+			s.counts = make([]atomic.Uint64, len(m.buckets))
+			s.buckets = m.buckets
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) writeTo(w *bufio.Writer) {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	all := make([]*series, len(keys))
+	for i, key := range keys {
+		all[i] = m.series[key]
+	}
+	m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, s := range all {
+		labels := formatLabels(m.labels, s.values)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, wrapLabels(labels), formatFloat(s.value.Load()))
+			continue
+		}
+
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += s.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, wrapLabels(joinLabels(labels, `le="`+formatFloat(le)+`"`)), cumulative)
+		}
+		count := s.count.Load()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, wrapLabels(joinLabels(labels, `le="+Inf"`)), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, wrapLabels(labels), formatFloat(s.sum.Load()))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, wrapLabels(labels), count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabel(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// series is one time series of a metric.
+type series struct {
+	values []string
+	value  atomicFloat
+
+	// Histograms only; counts are per bucket, not cumulative.
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomicFloat
+}
+
+func (s *series) Inc()           { s.value.Add(1) }
+func (s *series) Dec()           { s.value.Add(-1) }
+func (s *series) Add(v float64)  { s.value.Add(v) }
+func (s *series) Set(v float64)  { s.value.Store(v) }
+func (s *series) Value() float64 { return s.value.Load() }
+func (s *series) Count() uint64  { return s.count.Load() }
+func (s *series) Observe(v float64) {
+	if i, _ := slices.BinarySearch(s.buckets, v); i < len(s.buckets) {
+		s.counts[i].Add(1)
+	}
+	s.count.Add(1)
+	s.sum.Add(v)
+}
+
+// atomicFloat is a float64 that can be updated concurrently.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+func (f *atomicFloat) Store(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) Add(delta float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
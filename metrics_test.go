@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	var r registry
+	counter := r.newMetric("test_requests_total", "Requests.", "counter", nil, "proxy")
+	gauge := r.newMetric("test_streams", "Streams.", "gauge", nil)
+	hist := r.newMetric("test_latency_seconds", "Latency.", "histogram", []float64{0.1, 1}, "hop")
+
+	counter.with("env1").Inc()
+	counter.with("env1").Add(2)
+	counter.with(`we"ird\`).Inc()
+	gauge.with().Inc()
+	gauge.with().Inc()
+	gauge.with().Dec()
+	hist.with("bastion").Observe(0.05)
+	hist.with("bastion").Observe(0.5)
+	hist.with("bastion").Observe(1)
+	hist.with("bastion").Observe(5)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{proxy="env1"} 3
+test_requests_total{proxy="we\"ird\\"} 1
+# HELP test_streams Streams.
+# TYPE test_streams gauge
+test_streams 1
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{hop="bastion",le="0.1"} 1
+test_latency_seconds_bucket{hop="bastion",le="1"} 3
+test_latency_seconds_bucket{hop="bastion",le="+Inf"} 4
+test_latency_seconds_sum{hop="bastion"} 6.55
+test_latency_seconds_count{hop="bastion"} 4
+`
+	if buf.String() != expected {
+		t.Errorf("exposition =\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func TestRecordHandshake(t *testing.T) {
+	m := newProxsMetrics()
+
+	m.recordHandshake(protocolSOCKS5, nil)
+	m.recordHandshake(protocolSOCKS5, authenticationFailedError)
+	m.recordHandshake(protocolHTTP, errors.New("boom"))
+
+	for _, tt := range []struct {
+		protocol, outcome string
+	}{
+		{protocolSOCKS5, "success"},
+		{protocolSOCKS5, "auth_failed"},
+		{protocolHTTP, "error"},
+	} {
+		if got := m.handshakes.with(tt.protocol, tt.outcome).Value(); got != 1 {
+			t.Errorf("handshakes{%s,%s} = %v, expected 1", tt.protocol, tt.outcome, got)
+		}
+	}
+}
+
+func TestRecordChannelOpenFailure(t *testing.T) {
+	m := newProxsMetrics()
+
+	m.recordChannelOpenFailure("env1", &ssh.OpenChannelError{Reason: ssh.ConnectionFailed})
+	m.recordChannelOpenFailure("env1", errors.New("EOF"))
+
+	if got := m.channelOpenFails.with("env1", "connect_failed").Value(); got != 1 {
+		t.Errorf("connect_failed = %v, expected 1", got)
+	}
+	if got := m.channelOpenFails.with("env1", "error").Value(); got != 1 {
+		t.Errorf("error = %v, expected 1", got)
+	}
+
+	var buf bytes.Buffer
+	m.registry.WriteTo(&buf)
+	if !strings.Contains(buf.String(), `proxs_ssh_channel_open_failures_total{proxy="env1",reason="connect_failed"} 1`) {
+		t.Errorf("exposition does not contain the channel open failure:\n%s", buf.String())
+	}
+}
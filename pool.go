@@ -0,0 +1,558 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var poolClosedError = errors.New("ssh pool is closed")
+
+// sshPool keeps the SSH client chains of one proxy alive and shares them
+// between streams, so only the first requests pay for the handshake with
+// every hop. The pool holds up to size chains and spreads streams across
+// them; each chain is dialed through a member of the proxy's failover
+// group.
+type sshPool struct {
+	name     string
+	members  []*groupMember
+	failover FailoverConfig
+	size     int
+	balance  string
+
+	channelOpenTimeout time.Duration
+
+	// probeInterval is how often the members not in use are probed, from
+	// the first request on; see probeLoop.
+	probeInterval time.Duration
+	probing       sync.Once
+
+	// slots holds a token for each open stream when the number of streams
+	// is capped; maxPerClient caps the streams of each client.
+	slots        chan struct{}
+	maxPerClient int
+	queueTimeout time.Duration
+
+	mu      sync.Mutex
+	active  []*poolClient            // clients new streams are opened on
+	clients map[*poolClient]struct{} // every open client, active or retired
+	dialing chan struct{}            // closed when an in-flight dial completes
+	streams int
+	closed  bool
+	stop    chan struct{} // closed with the pool to stop reconnecting
+	changed chan struct{} // closed and replaced when a stream ends or a client is activated
+
+	next         int // next client for round-robin balancing
+	growing      bool
+	growFailedAt time.Time
+
+	failures     int // consecutive failed dials
+	reconnecting bool
+	nextRetry    time.Time
+
+	connectedAt time.Time
+	lastError   error
+	lastErrorAt time.Time
+}
+
+// poolClient is one dialed chain of a pool. A client that is no longer
+// active is retired: it stays open until its last stream is closed.
+type poolClient struct {
+	client  *ssh.Client
+	cleanup func()
+	member  *groupMember
+	streams int
+}
+
+func newSSHPool(name string, conn *sshConnection) *sshPool {
+	return newProxyPool(sshProxy{Name: name, Connections: []*sshConnection{conn}})
+}
+
+// newProxyPool returns the pool of sp, whose chain can be dialed through
+// any of its connections as chosen by its failover settings.
+func newProxyPool(sp sshProxy) *sshPool {
+	fc := sp.Failover
+	p := &sshPool{
+		name:               sp.Name,
+		failover:           fc,
+		size:               max(sp.PoolSize, 1),
+		balance:            cmp.Or(sp.Balance, balanceLeastStreams),
+		channelOpenTimeout: sp.channelOpenTimeout,
+		maxPerClient:       sp.MaxStreamsPerConnection,
+		queueTimeout:       cmp.Or(sp.QueueTimeout, defaultQueueTimeout),
+		changed:            make(chan struct{}),
+		clients:            make(map[*poolClient]struct{}),
+		stop:               make(chan struct{}),
+	}
+	if sp.MaxStreams > 0 {
+		p.slots = make(chan struct{}, sp.MaxStreams)
+	}
+	for i, conn := range sp.Connections {
+		weight := 1
+		if i < len(fc.Weights) {
+			weight = fc.Weights[i]
+		}
+		p.members = append(p.members, &groupMember{conn: conn, weight: weight})
+	}
+	if len(p.members) > 1 {
+		p.probeInterval = fc.ProbeInterval
+	}
+	return p
+}
+
+// get returns the client to open a stream on, dialing a chain if there is
+// none. While the proxy is down, it fails at once and leaves redialing to
+// the background reconnect.
+func (p *sshPool) get(ctx context.Context) (*poolClient, error) {
+	// Probing starts with the first request rather than with the pool, so
+	// that pools built and discarded by a reload never dial.
+	if p.probeInterval > 0 {
+		p.probing.Do(func() { go p.probeLoop(p.probeInterval) })
+	}
+
+	p.mu.Lock()
+	if len(p.active) == 0 && p.health() == healthDown {
+		err := fmt.Errorf("%w: %s, retrying in %s: %w", proxyDownError, p.name, max(time.Until(p.nextRetry), 0).Round(time.Second), p.lastError)
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.mu.Unlock()
+	return p.connect(ctx)
+}
+
+// connect returns a client to open a stream on, dialing a chain if there
+// is none. Concurrent callers wait for a single dial instead of each
+// building their own chain; the other chains of the pool are dialed in the
+// background.
+func (p *sshPool) connect(ctx context.Context) (*poolClient, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, poolClosedError
+		}
+		if len(p.active) > 0 {
+			pc := cmp.Or(p.pick(), p.active[0])
+			p.grow()
+			p.mu.Unlock()
+			return pc, nil
+		}
+		if dialing := p.dialing; dialing != nil {
+			p.mu.Unlock()
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		dialing := make(chan struct{})
+		p.dialing = dialing
+		p.mu.Unlock()
+
+		pc, err := p.dialGroup(ctx, nil)
+
+		p.mu.Lock()
+		p.dialing = nil
+		close(dialing)
+		if err == nil && p.closed {
+			pc.cleanup()
+			err = poolClosedError
+		}
+		if err != nil {
+			if !errors.Is(err, poolClosedError) && ctx.Err() == nil {
+				p.recordDial(err)
+			}
+			p.mu.Unlock()
+			return nil, err
+		}
+		if !p.connectedAt.IsZero() {
+			metrics.sshReconnects.with(p.name).Inc()
+		}
+		p.adopt(pc)
+		p.activate(pc, nil)
+		p.recordDial(nil)
+		p.grow()
+		p.mu.Unlock()
+		return pc, nil
+	}
+}
+
+// adopt starts tracking a freshly dialed client. p.mu must be held.
+func (p *sshPool) adopt(pc *poolClient) {
+	p.clients[pc] = struct{}{}
+	go p.watch(pc)
+}
+
+// activate lets new streams be opened on pc, in place of replaced if it is
+// active, which is then retired. p.mu must be held.
+func (p *sshPool) activate(pc, replaced *poolClient) {
+	p.connectedAt = time.Now()
+	if i := slices.Index(p.active, replaced); replaced != nil && i >= 0 {
+		p.active[i] = pc
+		p.retire(replaced)
+		return
+	}
+	p.active = append(p.active, pc)
+	p.signal()
+}
+
+// isActive reports whether new streams may be opened on pc. p.mu must be
+// held.
+func (p *sshPool) isActive(pc *poolClient) bool {
+	return slices.Contains(p.active, pc)
+}
+
+// retire closes pc once no stream uses it. p.mu must be held.
+func (p *sshPool) retire(pc *poolClient) {
+	p.active = slices.DeleteFunc(p.active, func(a *poolClient) bool { return a == pc })
+	if pc.streams == 0 {
+		p.closeClient(pc)
+	}
+}
+
+// closeClient closes pc and every jump host below it. p.mu must be held.
+func (p *sshPool) closeClient(pc *poolClient) {
+	p.active = slices.DeleteFunc(p.active, func(a *poolClient) bool { return a == pc })
+	if _, ok := p.clients[pc]; ok {
+		delete(p.clients, pc)
+		pc.cleanup()
+	}
+}
+
+// discard drops pc, aborting its streams, so that the next request dials
+// a fresh chain.
+func (p *sshPool) discard(pc *poolClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeClient(pc)
+}
+
+// watch forgets pc once its connection is closed, whether by a missed
+// keepalive on any hop or by the server, so that streams riding on it fail
+// and the next request dials a fresh chain.
+func (p *sshPool) watch(pc *poolClient) {
+	err := pc.client.Wait()
+
+	p.mu.Lock()
+	lost := p.isActive(pc)
+	p.closeClient(pc)
+	if lost {
+		p.lastError, p.lastErrorAt = fmt.Errorf("ssh connection lost: %w", err), time.Now()
+		if len(p.active) == 0 {
+			p.startReconnect()
+		}
+	}
+	p.mu.Unlock()
+
+	if lost {
+		slog.Warn("SSH connection lost, reconnecting", "proxy", p.name, "hostname", pc.member.conn.HostName, "error", err)
+	}
+}
+
+// openChannel opens a direct-tcpip channel to addr over pc, on which the
+// stream has been reserved.
+func (p *sshPool) openChannel(ctx context.Context, pc *poolClient, network, addr string) (net.Conn, error) {
+	ctx, cancel, timedOut := withTimeout(ctx, p.channelOpenTimeout, channelOpenTimeoutError)
+	defer cancel()
+	conn, err := pc.client.DialContext(ctx, network, addr)
+	if err != nil {
+		err = timedOut(err)
+		metrics.recordChannelOpenFailure(p.name, err)
+		p.endStream(pc)
+		return nil, err
+	}
+	metrics.activeStreams.with(p.name).Inc()
+	return &poolConn{Conn: conn, pool: p, client: pc}, nil
+}
+
+// Dial opens a direct-tcpip channel to addr through the proxy. A failure to
+// open the channel on a reused client is retried once on a fresh chain, as
+// the shared connection may have died since it was last used. When the
+// server refuses the channel, the other members of a failover group are
+// tried, as they may reach addr.
+func (p *sshPool) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	queue := time.NewTimer(p.queueTimeout)
+	defer queue.Stop()
+	if err := p.acquireSlot(ctx, queue.C); err != nil {
+		return nil, err
+	}
+	conn, err := p.dial(ctx, network, addr, queue.C)
+	if err != nil {
+		p.releaseSlot()
+	}
+	return conn, err
+}
+
+func (p *sshPool) dial(ctx context.Context, network, addr string, queue <-chan time.Time) (net.Conn, error) {
+	pc, err := p.reserve(ctx, queue)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.openChannel(ctx, pc, network, addr)
+	if err == nil || ctx.Err() != nil {
+		return conn, err
+	}
+
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		// The server answered, so the connection itself is fine.
+		if openErr.Reason == ssh.Prohibited || len(p.members) == 1 {
+			return nil, err
+		}
+		if conn, altErr := p.dialAlternate(ctx, pc, network, addr); altErr == nil {
+			return conn, nil
+		}
+		return nil, err
+	}
+
+	slog.WarnContext(ctx, "SSH connection seems broken, redialing", "proxy", p.name, "hostname", pc.member.conn.HostName, "error", err)
+	p.discard(pc)
+	if pc, err = p.reserve(ctx, queue); err != nil {
+		return nil, err
+	}
+	return p.openChannel(ctx, pc, network, addr)
+}
+
+// dialAlternate opens a channel to addr over a member of the group other
+// than the one of failed. On success the new chain replaces failed for
+// new streams.
+func (p *sshPool) dialAlternate(ctx context.Context, failed *poolClient, network, addr string) (net.Conn, error) {
+	alt, err := p.dialGroup(ctx, failed.member)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		alt.cleanup()
+		return nil, poolClosedError
+	}
+	p.adopt(alt)
+	p.countStream(alt)
+	p.mu.Unlock()
+
+	conn, err := p.openChannel(ctx, alt, network, addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.retire(alt)
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Failed over to alternate SSH host", "proxy", p.name, "from", failed.member.conn.String(), "to", alt.member.conn.String())
+	if p.isActive(failed) || len(p.active) < p.size {
+		p.activate(alt, failed)
+	} else {
+		p.retire(alt)
+	}
+	return conn, nil
+}
+
+// Check sends a keepalive request over the active clients, if any, and
+// drops those whose server does not answer. It fails when none is left.
+func (p *sshPool) Check() error {
+	p.mu.Lock()
+	active := slices.Clone(p.active)
+	if len(active) == 0 {
+		defer p.mu.Unlock()
+		if p.health() == healthDown {
+			return fmt.Errorf("%w: %s: %w", proxyDownError, p.name, p.lastError)
+		}
+		return nil
+	}
+	p.mu.Unlock()
+
+	var errs []error
+	for _, pc := range active {
+		if err := sendKeepalive(pc.client, keepaliveCheckTimeout); err != nil {
+			p.discard(pc)
+			errs = append(errs, fmt.Errorf("ssh connection to %s is dead: %w", pc.member.conn.HostName, err))
+		}
+	}
+	if len(errs) == len(active) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// poolStats is a snapshot of the state of an sshPool.
+type poolStats struct {
+	Health        string        `json:"health"`
+	Failures      int           `json:"consecutive_failures,omitempty"`
+	NextRetry     *time.Time    `json:"next_retry,omitempty"`
+	Connected     bool          `json:"connected"`
+	Connections   int           `json:"connections"`
+	Streams       int           `json:"streams"`
+	Closed        bool          `json:"closed"`
+	ConnectedAt   *time.Time    `json:"connected_at,omitempty"`
+	ServerVersion string        `json:"server_version,omitempty"`
+	LastError     string        `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time    `json:"last_error_at,omitempty"`
+	Hops          []hopStats    `json:"hops"`
+	Members       []memberStats `json:"members,omitempty"`
+}
+
+// hopStats is the state of one hop of the chain. Every hop is connected
+// while the pool holds a client, as the chain is dialed and torn down as a
+// whole.
+type hopStats struct {
+	Address   string `json:"address"`
+	Connected bool   `json:"connected"`
+}
+
+func (p *sshPool) stats() poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	connected := len(p.active) > 0
+	st := poolStats{Health: p.health(), Failures: p.failures, Connected: connected, Connections: len(p.active), Streams: p.streams, Closed: p.closed}
+	if p.reconnecting && !connected {
+		nextRetry := p.nextRetry
+		st.NextRetry = &nextRetry
+	}
+	active := p.members[0]
+	if connected {
+		connectedAt := p.connectedAt
+		st.ConnectedAt = &connectedAt
+		st.ServerVersion = string(p.active[0].client.ServerVersion())
+		active = p.active[0].member
+	}
+	if p.lastError != nil {
+		lastErrorAt := p.lastErrorAt
+		st.LastError = p.lastError.Error()
+		st.LastErrorAt = &lastErrorAt
+	}
+	for _, hop := range active.conn.Chain() {
+		st.Hops = append(st.Hops, hopStats{Address: hop.String(), Connected: connected})
+	}
+	if len(p.members) > 1 {
+		inUse := p.membersInUse()
+		for _, m := range p.members {
+			st.Members = append(st.Members, m.stats(inUse[m]))
+		}
+	}
+	return st
+}
+
+// Reconnect closes the active clients, aborting the streams using them,
+// and dials a new chain.
+func (p *sshPool) Reconnect(ctx context.Context) error {
+	p.mu.Lock()
+	for _, pc := range slices.Clone(p.active) {
+		p.closeClient(pc)
+	}
+	p.mu.Unlock()
+
+	_, err := p.connect(ctx)
+	return err
+}
+
+// release is called when a stream opened over pc is closed.
+func (p *sshPool) release(pc *poolClient) {
+	metrics.activeStreams.with(p.name).Dec()
+	p.endStream(pc)
+	p.releaseSlot()
+}
+
+// countStream counts a stream on pc. p.mu must be held.
+func (p *sshPool) countStream(pc *poolClient) {
+	pc.streams++
+	p.streams++
+}
+
+// endStream stops counting a stream of pc, closing pc if it was the last
+// one of a retired client, or of a client opened beyond the pool's size
+// because the others were full.
+func (p *sshPool) endStream(pc *poolClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc.streams--
+	p.streams--
+	switch {
+	case pc.streams > 0:
+	case p.closed || !p.isActive(pc):
+		p.closeClient(pc)
+	case len(p.active) > p.size:
+		slog.Debug("Closing idle additional SSH connection", "proxy", p.name, "connections", len(p.active)-1)
+		p.retire(pc)
+	}
+	p.signal()
+}
+
+// signal wakes up the requests waiting for room on a client. p.mu must be
+// held.
+func (p *sshPool) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Drain stops the pool from opening new streams and closes its clients
+// once the streams still using them are closed.
+func (p *sshPool) Drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.markClosed()
+	for pc := range p.clients {
+		p.retire(pc)
+	}
+}
+
+// Close closes every client and the jump hosts below them, aborting the
+// streams still using them.
+func (p *sshPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.markClosed()
+	for pc := range p.clients {
+		p.closeClient(pc)
+	}
+}
+
+// markClosed stops the pool from dialing again. p.mu must be held.
+func (p *sshPool) markClosed() {
+	if !p.closed {
+		p.closed = true
+		close(p.stop)
+	}
+}
+
+// poolConn is a stream opened through an sshPool. Closing it releases the
+// stream's hold on the client it was opened over.
+type poolConn struct {
+	net.Conn
+	pool   *sshPool
+	client *poolClient
+	once   sync.Once
+}
+
+func (c *poolConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.pool.release(c.client) })
+	return err
+}
+
+// CloseWrite sends EOF on the channel, which stays open for reading.
+func (c *poolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// chain returns the hops the stream was opened through.
+func (c *poolConn) chain() []string {
+	return chainStrings(c.client.member.conn)
+}
@@ -1,15 +1,41 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
 )
 
 var unsupportedSocksVersionError = errors.New("unsupported SOCKS version")
 var noAuthMethodsError = errors.New("no authentication methods provided")
+var noAcceptableMethodsError = errors.New("no acceptable authentication methods")
+var unsupportedAuthVersionError = errors.New("unsupported username/password authentication version")
+var unsupportedCommandError = errors.New("unsupported SOCKS command")
+var unsupportedAddressTypeError = errors.New("unsupported SOCKS address type")
+
+// Reply codes of RFC 1928 section 6.
+const (
+	socksSucceeded          = byte(0x00)
+	socksGeneralFailure     = byte(0x01)
+	socksNotAllowed         = byte(0x02)
+	socksNetworkUnreachable = byte(0x03)
+	socksHostUnreachable    = byte(0x04)
+	socksConnectionRefused  = byte(0x05)
+	socksTTLExpired         = byte(0x06)
+	socksCommandUnsupported = byte(0x07)
+	socksAddressUnsupported = byte(0x08)
+)
+
+const (
+	authMethodNoAuth       = byte(0x00)
+	authMethodUserPass     = byte(0x02)
+	authMethodNoAcceptable = byte(0xFF)
+)
 
 // https://datatracker.ietf.org/doc/html/rfc1928#autoid-3
 //
@@ -32,10 +58,6 @@ func ParseAuthMethod(r io.Reader) (am AuthMethods, err error) {
 	am.Ver = buf[0]
 	am.NMethods = buf[1]
 
-	if am.NMethods > 255 {
-		return am, io.ErrShortBuffer
-	}
-
 	am.Methods = make([]byte, am.NMethods)
 	if _, err := io.ReadFull(r, am.Methods); err != nil {
 		return am, err
@@ -43,6 +65,47 @@ func ParseAuthMethod(r io.Reader) (am AuthMethods, err error) {
 	return am, nil
 }
 
+// https://datatracker.ietf.org/doc/html/rfc1929#section-2
+//
+//	+----+------+----------+------+----------+
+//	|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+//	+----+------+----------+------+----------+
+//	| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+//	+----+------+----------+------+----------+
+type UserPassRequest struct {
+	Ver      byte
+	Username string
+	Password string
+}
+
+func ParseUserPassRequest(r io.Reader) (UserPassRequest, error) {
+	var req UserPassRequest
+	var buf [2]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return req, err
+	}
+	req.Ver = buf[0]
+	if req.Ver != 1 {
+		return UserPassRequest{}, unsupportedAuthVersionError
+	}
+
+	uname := make([]byte, buf[1])
+	if _, err := io.ReadFull(r, uname); err != nil {
+		return UserPassRequest{}, err
+	}
+	req.Username = string(uname)
+
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return UserPassRequest{}, err
+	}
+	passwd := make([]byte, buf[0])
+	if _, err := io.ReadFull(r, passwd); err != nil {
+		return UserPassRequest{}, err
+	}
+	req.Password = string(passwd)
+	return req, nil
+}
+
 type Request struct {
 	Ver      byte
 	Command  byte
@@ -70,17 +133,25 @@ func ParseRequest(r io.Reader) (Request, error) {
 	req.AddrType = buf[3]
 
 	if req.Ver != 5 {
-		return Request{}, io.ErrUnexpectedEOF
+		return Request{}, unsupportedSocksVersionError
 	}
 
-	// Under prototype, we handle only CONNECT command.
+	// Only the CONNECT command is supported.
 	if req.Command != 1 {
-		return Request{}, io.ErrUnexpectedEOF
+		return Request{}, unsupportedCommandError
 	}
 
-	// under prototype, we handle only domain address types.
 	switch req.AddrType {
-	case byte(0x01), byte(0x03):
+	case byte(0x01), byte(0x04):
+		ip := make([]byte, net.IPv4len)
+		if req.AddrType == byte(0x04) {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return Request{}, err
+		}
+		req.DestAddr = net.IP(ip).String()
+	case byte(0x03):
 		tmp := make([]byte, 1)
 		if _, err := io.ReadFull(r, tmp); err != nil {
 			return Request{}, err
@@ -91,59 +162,121 @@ func ParseRequest(r io.Reader) (Request, error) {
 			return Request{}, err
 		}
 		req.DestAddr = string(domain)
-		port := make([]byte, 2)
-		if _, err := io.ReadFull(r, port); err != nil {
-			return Request{}, err
-		}
-		req.DestPort = uint16(port[0])<<8 | uint16(port[1])
 	default:
-		return Request{}, io.EOF
+		return Request{}, unsupportedAddressTypeError
 	}
 
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return Request{}, err
+	}
+	req.DestPort = uint16(port[0])<<8 | uint16(port[1])
 	return req, nil
 }
 
-func socksConnection(src net.Conn, cfg *Config) (destAddr string, destPort uint16, err error) {
-	buffer := bufio.NewReader(src)
+// socksConnection runs the SOCKS5 handshake on src up to the request. When
+// users is not empty, clients must authenticate with RFC 1929
+// username/password. The request is answered by writeSocksReply once the
+// destination has been dialed.
+func socksConnection(ctx context.Context, src net.Conn, users map[string]string) (cr clientRequest, err error) {
+	defer func() { metrics.recordHandshake(protocolSOCKS5, err) }()
+	defer abortOnDone(ctx, src)()
+	buffer := readerFor(src)
 
 	am, err := ParseAuthMethod(buffer)
 	if err != nil {
-		log.Printf("Failed to parse authentication method: %v", err)
+		slog.DebugContext(ctx, "Failed to parse authentication method", "error", err)
 		return
 	}
 
 	if am.Ver != 5 {
-		log.Printf("Unsupported SOCKS version: %d", am.Ver)
-		return "", 0, unsupportedSocksVersionError
+		slog.DebugContext(ctx, "Unsupported SOCKS version", "version", am.Ver)
+		return clientRequest{}, unsupportedSocksVersionError
 	}
 
 	if am.NMethods == 0 || len(am.Methods) == 0 {
-		log.Println("No authentication methods provided")
-		return "", 0, noAuthMethodsError
+		slog.DebugContext(ctx, "No authentication methods provided")
+		return clientRequest{}, noAuthMethodsError
 	}
 
-	src.Write([]byte{5, 0}) // Reply with no authentication required
+	method := authMethodNoAuth
+	if len(users) > 0 {
+		method = authMethodUserPass
+	}
+	if !slices.Contains(am.Methods, method) {
+		src.Write([]byte{5, authMethodNoAcceptable})
+		return clientRequest{}, noAcceptableMethodsError
+	}
+	src.Write([]byte{5, method})
+
+	if method == authMethodUserPass {
+		up, err := ParseUserPassRequest(buffer)
+		if err != nil {
+			slog.DebugContext(ctx, "Failed to parse username/password request", "error", err)
+			return clientRequest{}, err
+		}
+		if !checkPassword(users, up.Username, up.Password) {
+			src.Write([]byte{1, 1})
+			return clientRequest{}, authenticationFailedError
+		}
+		src.Write([]byte{1, 0})
+		cr.User = up.Username
+	}
 
 	request, err := ParseRequest(buffer)
 	if err != nil {
-		log.Printf("Failed to parse request: %v", err)
+		slog.DebugContext(ctx, "Failed to parse request", "error", err)
+		if errors.Is(err, unsupportedCommandError) || errors.Is(err, unsupportedAddressTypeError) {
+			writeSocksReply(src, err)
+		}
 		return
 	}
 
-	log.Printf("Received request: %+v", request)
+	slog.DebugContext(ctx, "Received request", "command", request.Command, "addrType", request.AddrType, "destAddr", request.DestAddr, "destPort", request.DestPort)
 
-	// Create reply request
+	cr.Protocol = protocolSOCKS5
+	cr.Host = request.DestAddr
+	cr.Port = request.DestPort
+	return cr, nil
+}
+
+// writeSocksReply answers a CONNECT request with the reply code for err,
+// which is nil when the destination was dialed.
+func writeSocksReply(w io.Writer, err error) error {
 	rep := Reply{
 		Ver:      5,
-		Rep:      0, // Success
+		Rep:      socksReplyFor(err),
 		AddrType: byte(0x01),
 		BndAddr:  [4]byte{0, 0, 0, 0},
 		BndPort:  0,
 	}
+	_, err = w.Write([]byte{rep.Ver, rep.Rep, byte(0x00), rep.AddrType, rep.BndAddr[0], rep.BndAddr[1], rep.BndAddr[2], rep.BndAddr[3], byte(rep.BndPort >> 8), byte(rep.BndPort & 0xff)})
+	return err
+}
 
-	if _, err = src.Write([]byte{rep.Ver, rep.Rep, byte(0x00), rep.AddrType, rep.BndAddr[0], rep.BndAddr[1], rep.BndAddr[2], rep.BndAddr[3], byte(rep.BndPort >> 8), byte(rep.BndPort & 0xff)}); err != nil {
-		log.Printf("Failed to send reply: %v", err)
-		return
+// socksReplyFor maps a routing or dial error to a SOCKS5 reply code.
+func socksReplyFor(err error) byte {
+	var openErr *ssh.OpenChannelError
+	switch {
+	case err == nil:
+		return socksSucceeded
+	case errors.Is(err, noMatchingProxyError), errors.Is(err, destinationDeniedError):
+		return socksNotAllowed
+	case errors.Is(err, unsupportedCommandError):
+		return socksCommandUnsupported
+	case errors.Is(err, unsupportedAddressTypeError):
+		return socksAddressUnsupported
+	case errors.Is(err, proxyDownError):
+		return socksNetworkUnreachable
+	case errors.Is(err, context.DeadlineExceeded):
+		return socksTTLExpired
+	case errors.As(err, &openErr):
+		switch openErr.Reason {
+		case ssh.Prohibited:
+			return socksNotAllowed
+		case ssh.ConnectionFailed:
+			return socksConnectionRefused
+		}
 	}
-	return request.DestAddr, request.DestPort, nil
+	return socksGeneralFailure
 }
@@ -2,10 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"reflect"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 func TestParseAuthMethod(t *testing.T) {
@@ -98,17 +104,30 @@ func TestParseRequest(t *testing.T) {
 		},
 		{
 			name: "Valid CONNECT request with IPv4",
-			// Ver=5, Cmd=1, Reserved=0, AddrType=1, DomainLen=11, Domain="example.com", Port=443
-			input: []byte{5, 1, 0, 1, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187},
+			// Ver=5, Cmd=1, Reserved=0, AddrType=1, Addr=10.0.0.1, Port=443
+			input: []byte{5, 1, 0, 1, 10, 0, 0, 1, 1, 187},
 			expected: Request{
 				Ver:      5,
 				Command:  1,
 				AddrType: 1,
-				DestAddr: "example.com",
+				DestAddr: "10.0.0.1",
 				DestPort: 443,
 			},
 			wantErr: false,
 		},
+		{
+			name: "Valid CONNECT request with IPv6",
+			// Ver=5, Cmd=1, Reserved=0, AddrType=4, Addr=2001:db8::1, Port=8080
+			input: []byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90},
+			expected: Request{
+				Ver:      5,
+				Command:  1,
+				AddrType: 4,
+				DestAddr: "2001:db8::1",
+				DestPort: 8080,
+			},
+			wantErr: false,
+		},
 		{
 			name:    "Invalid version",
 			input:   []byte{4, 1, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80},
@@ -121,7 +140,7 @@ func TestParseRequest(t *testing.T) {
 		},
 		{
 			name:    "Unsupported address type",
-			input:   []byte{5, 1, 0, 4, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80},
+			input:   []byte{5, 1, 0, 5, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80},
 			wantErr: true,
 		},
 		{
@@ -156,17 +175,15 @@ func TestParseRequest(t *testing.T) {
 }
 
 func TestSocksConnection(t *testing.T) {
-	// Create a mock config
-	cfg := &Config{
-		ListenPort: 1080,
-		Proxies:    make(map[string]sshProxy),
-	}
+	users := map[string]string{"alice": "secret"}
 
 	tests := []struct {
 		name         string
+		users        map[string]string
 		clientData   []byte
 		expectedAddr string
 		expectedPort uint16
+		expectedUser string
 		wantErr      bool
 	}{
 		{
@@ -179,6 +196,32 @@ func TestSocksConnection(t *testing.T) {
 			clientData: []byte{5, 0}, // NMethods=0
 			wantErr:    true,
 		},
+		{
+			name:         "No authentication",
+			clientData:   append([]byte{5, 1, 0}, createSOCKS5Request("example.com", 443)...),
+			expectedAddr: "example.com",
+			expectedPort: 443,
+		},
+		{
+			name:       "Username/password required but not offered",
+			users:      users,
+			clientData: []byte{5, 1, 0},
+			wantErr:    true,
+		},
+		{
+			name:         "Valid username/password",
+			users:        users,
+			clientData:   append(append([]byte{5, 1, 2}, createUserPassRequest("alice", "secret")...), createSOCKS5Request("example.com", 22)...),
+			expectedAddr: "example.com",
+			expectedPort: 22,
+			expectedUser: "alice",
+		},
+		{
+			name:       "Wrong password",
+			users:      users,
+			clientData: append([]byte{5, 1, 2}, createUserPassRequest("alice", "wrong")...),
+			wantErr:    true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -190,25 +233,21 @@ func TestSocksConnection(t *testing.T) {
 
 			// Start socksConnection in a goroutine
 			resultChan := make(chan struct {
-				addr string
-				port uint16
-				err  error
+				req clientRequest
+				err error
 			}, 1)
 
 			go func() {
-				addr, port, err := socksConnection(server, cfg)
+				req, err := socksConnection(context.Background(), server, tt.users)
 				resultChan <- struct {
-					addr string
-					port uint16
-					err  error
-				}{addr, port, err}
+					req clientRequest
+					err error
+				}{req, err}
 			}()
 
-			// Send client data
-			go func() {
-				defer client.Close()
-				client.Write(tt.clientData)
-			}()
+			// Send client data and drain the server replies
+			go client.Write(tt.clientData)
+			go io.Copy(io.Discard, client)
 
 			// Wait for result with timeout
 			select {
@@ -225,12 +264,16 @@ func TestSocksConnection(t *testing.T) {
 					return
 				}
 
-				if result.addr != tt.expectedAddr {
-					t.Errorf("socksConnection() addr = %s, expected %s", result.addr, tt.expectedAddr)
+				if result.req.Host != tt.expectedAddr {
+					t.Errorf("socksConnection() addr = %s, expected %s", result.req.Host, tt.expectedAddr)
+				}
+
+				if result.req.Port != tt.expectedPort {
+					t.Errorf("socksConnection() port = %d, expected %d", result.req.Port, tt.expectedPort)
 				}
 
-				if result.port != tt.expectedPort {
-					t.Errorf("socksConnection() port = %d, expected %d", result.port, tt.expectedPort)
+				if result.req.User != tt.expectedUser {
+					t.Errorf("socksConnection() user = %s, expected %s", result.req.User, tt.expectedUser)
 				}
 
 			case <-time.After(5 * time.Second):
@@ -253,6 +296,62 @@ func createSOCKS5Request(domain string, port uint16) []byte {
 	return request
 }
 
+// Helper function to create an RFC 1929 username/password request
+func createUserPassRequest(user, password string) []byte {
+	request := []byte{1, byte(len(user))}
+	request = append(request, user...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	return request
+}
+
+func TestParseUserPassRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		expected UserPassRequest
+		wantErr  bool
+	}{
+		{
+			name:     "Valid request",
+			input:    createUserPassRequest("alice", "secret"),
+			expected: UserPassRequest{Ver: 1, Username: "alice", Password: "secret"},
+		},
+		{
+			name:    "Invalid version",
+			input:   []byte{5, 1, 'a', 1, 'b'},
+			wantErr: true,
+		},
+		{
+			name:    "Truncated password",
+			input:   []byte{1, 1, 'a', 3, 'b'},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseUserPassRequest(bytes.NewReader(tt.input))
+
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseUserPassRequest() expected error, but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("ParseUserPassRequest() unexpected error: %v", err)
+				return
+			}
+
+			if result != tt.expected {
+				t.Errorf("ParseUserPassRequest() = %+v, expected %+v", result, tt.expected)
+			}
+		})
+	}
+}
+
 func TestCreateSOCKS5Request(t *testing.T) {
 	// Test the helper function itself
 	result := createSOCKS5Request("google.com", 443)
@@ -281,3 +380,27 @@ func BenchmarkParseRequest(b *testing.B) {
 		ParseRequest(reader)
 	}
 }
+
+func TestSocksReplyFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected byte
+	}{
+		{"success", nil, socksSucceeded},
+		{"no route", fmt.Errorf("%w for address: db", noMatchingProxyError), socksNotAllowed},
+		{"proxy down", fmt.Errorf("%w: env1", proxyDownError), socksNetworkUnreachable},
+		{"timeout", context.DeadlineExceeded, socksTTLExpired},
+		{"refused", &ssh.OpenChannelError{Reason: ssh.ConnectionFailed}, socksConnectionRefused},
+		{"prohibited", &ssh.OpenChannelError{Reason: ssh.Prohibited}, socksNotAllowed},
+		{"other", errors.New("boom"), socksGeneralFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rep := socksReplyFor(tt.err); rep != tt.expected {
+				t.Errorf("socksReplyFor() = %#x, expected %#x", rep, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+const (
+	// defaultBufferSize holds four SSH packets, so that a read from the
+	// client fills several packets of the channel.
+	defaultBufferSize = 128 << 10
+	minBufferSize     = 4 << 10
+	maxBufferSize     = 16 << 20
+)
+
+// RelayConfig tunes the copy between clients and destinations. BufferSize
+// is the size in bytes of the buffer used for each direction.
+type RelayConfig struct {
+	BufferSize int `toml:"buffer_size"`
+}
+
+func (rc RelayConfig) validate() error {
+	if rc.BufferSize != 0 && (rc.BufferSize < minBufferSize || rc.BufferSize > maxBufferSize) {
+		return fmt.Errorf("buffer_size must be between %d and %d bytes", minBufferSize, maxBufferSize)
+	}
+	return nil
+}
+
+func (rc RelayConfig) bufferSize() int {
+	if rc.BufferSize == 0 {
+		return defaultBufferSize
+	}
+	return rc.BufferSize
+}
+
+// relayBuffers holds a pool of relay buffers for each size in use, so that
+// connections reuse the buffers of those that ended instead of allocating
+// their own.
+var relayBuffers sync.Map // int -> *sync.Pool
+
+func getBuffer(size int) *[]byte {
+	pool, ok := relayBuffers.Load(size)
+	if !ok {
+		pool, _ = relayBuffers.LoadOrStore(size, &sync.Pool{
+			New: func() any {
+				buf := make([]byte, size)
+				return &buf
+			},
+		})
+	}
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	if pool, ok := relayBuffers.Load(len(*buf)); ok {
+		pool.(*sync.Pool).Put(buf)
+	}
+}
+
+// closeWriter is implemented by connections that can be half-closed: TCP
+// and Unix sockets send a FIN, SSH channels an EOF.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies between the client src and the destination dst in both
+// directions. When one side finishes sending, the end of its stream is
+// passed on to the other side, which may keep sending; both connections
+// are closed once both directions are done, or as soon as one fails. The
+// side that finished first is recorded as the close reason of the session.
+// Each direction copies through a pooled buffer of bufSize bytes, at the
+// rate allowed by its shaper.
+func relay(ctx context.Context, sess *session, src, dst net.Conn, proxy string, bufSize int, up, down shaper) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := up.writer(ctx, countingWriter{dst, &sess.bytesOut, metrics.bytes.with(proxy, "out"), &sess.lastActive})
+		pipe(ctx, sess, w, src, dst, closeClient, bufSize)
+	}()
+	w := down.writer(ctx, countingWriter{src, &sess.bytesIn, metrics.bytes.with(proxy, "in"), &sess.lastActive})
+	pipe(ctx, sess, w, dst, src, closeDestination, bufSize)
+	<-done
+
+	src.Close()
+	dst.Close()
+}
+
+// pipe copies what is read from from to w, which writes to to, and then
+// half-closes to. When the copy fails or to cannot be half-closed, both
+// connections are closed so that the opposite direction stops too. reason
+// identifies the side sending on from.
+func pipe(ctx context.Context, sess *session, w io.Writer, from, to net.Conn, reason string, bufSize int) {
+	buf := getBuffer(bufSize)
+	_, err := io.CopyBuffer(w, from, *buf)
+	putBuffer(buf)
+	sess.setCloseReason(reason)
+	if err != nil {
+		slog.DebugContext(ctx, "Error relaying connection", "closed_by", reason, "error", err)
+	} else if cw, ok := to.(closeWriter); ok {
+		if err := cw.CloseWrite(); err == nil {
+			slog.DebugContext(ctx, "Connection half-closed", "closed_by", reason)
+			return
+		}
+	}
+	from.Close()
+	to.Close()
+}
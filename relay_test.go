@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bean1310/proxs/internal/sshtest"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c, s
+}
+
+// exchange sends msg from first and closes its write half, then checks
+// that second receives msg up to EOF and can still answer with reply
+// before closing.
+func exchange(t *testing.T, first, second net.Conn, msg, reply string) {
+	t.Helper()
+
+	errc := make(chan error, 1)
+	go func() {
+		got, err := io.ReadAll(second)
+		if err == nil && string(got) != msg {
+			t.Errorf("received %q, expected %q", got, msg)
+		}
+		if err == nil {
+			_, err = second.Write([]byte(reply))
+		}
+		second.Close()
+		errc <- err
+	}()
+
+	if _, err := first.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != reply {
+		t.Errorf("received %q after half-close, expected %q", got, reply)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	tests := []struct {
+		name        string
+		clientFirst bool
+		reason      string
+	}{
+		{"client closes first", true, closeClient},
+		{"destination closes first", false, closeDestination},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(&Config{Proxies: map[string]sshProxy{}}, nil)
+			client, src := tcpPair(t)
+			dst, target := tcpPair(t)
+			sess, ctx := srv.sessions.add(context.Background(), src, "127.0.0.1:1080")
+			defer srv.sessions.remove(sess)
+
+			done := make(chan struct{})
+			go func() {
+				relay(ctx, sess, newBufferedConn(src), dst, "env1", defaultBufferSize, shaper{}, shaper{})
+				close(done)
+			}()
+
+			if tt.clientFirst {
+				exchange(t, client, target, "request", "response")
+			} else {
+				exchange(t, target, client, "banner", "bye")
+			}
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("relay() did not return once both sides were closed")
+			}
+			if reason := sess.getCloseReason(); reason != tt.reason {
+				t.Errorf("close reason = %q, expected %q", reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRelayHalfCloseOverSSH(t *testing.T) {
+	sshtest.UseAgent(t)
+	proxyHost := sshtest.NewServer(t)
+	pool := newProxyPool(sshProxy{Name: "env1", Connections: []*sshConnection{sshConn(proxyHost, nil)}})
+	defer pool.Close()
+
+	// The destination answers once the client has finished sending.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		got, _ := io.ReadAll(c)
+		c.Write(append([]byte("echo: "), got...))
+	}()
+
+	dst, err := pool.Dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(&Config{Proxies: map[string]sshProxy{}}, nil)
+	client, src := tcpPair(t)
+	sess, ctx := srv.sessions.add(context.Background(), src, "127.0.0.1:1080")
+	defer srv.sessions.remove(sess)
+	go relay(ctx, sess, newBufferedConn(src), dst, "env1", defaultBufferSize, shaper{}, shaper{})
+
+	client.Write([]byte("ping"))
+	client.(*net.TCPConn).CloseWrite()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "echo: ping" {
+		t.Errorf("received %q, expected %q", got, "echo: ping")
+	}
+}
+
+// benchmarkRelay measures relaying connections that each download size
+// bytes from a target behind an in-process SSH server.
+func benchmarkRelay(b *testing.B, size, bufSize int) {
+	sshtest.UseAgent(b)
+	proxyHost := sshtest.NewServer(b)
+	pool := newProxyPool(sshProxy{Name: "bench", Connections: []*sshConnection{sshConn(proxyHost, nil)}})
+	defer pool.Close()
+
+	payload := make([]byte, size)
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write(payload)
+			}()
+		}
+	}()
+
+	clients, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clients.Close()
+
+	srv := newServer(&Config{Proxies: map[string]sshProxy{}}, nil)
+	ctx := context.Background()
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		client, err := net.Dial("tcp", clients.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		src, err := clients.Accept()
+		if err != nil {
+			b.Fatal(err)
+		}
+		dst, err := pool.Dial(ctx, "tcp", target.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		sess, sctx := srv.sessions.add(ctx, src, "127.0.0.1:1080")
+		go func() {
+			relay(sctx, sess, newBufferedConn(src), dst, "bench", bufSize, shaper{}, shaper{})
+			srv.sessions.remove(sess)
+		}()
+
+		n, err := io.Copy(io.Discard, client)
+		client.Close()
+		if err != nil || n != int64(size) {
+			b.Fatalf("received %d bytes (%v), expected %d", n, err, size)
+		}
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	for _, size := range []int{1 << 10, 1 << 20, 16 << 20} {
+		for _, bufSize := range []int{32 << 10, defaultBufferSize} {
+			b.Run(fmt.Sprintf("size=%dKiB/buffer=%dKiB", size>>10, bufSize>>10), func(b *testing.B) {
+				benchmarkRelay(b, size, bufSize)
+			})
+		}
+	}
+}
+
+// BenchmarkChannelOpen measures the latency of opening a stream over an
+// established SSH connection and getting the first byte back.
+func BenchmarkChannelOpen(b *testing.B) {
+	sshtest.UseAgent(b)
+	proxyHost := sshtest.NewServer(b)
+	pool := newProxyPool(sshProxy{Name: "bench", Connections: []*sshConnection{sshConn(proxyHost, nil)}})
+	defer pool.Close()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte{1})
+			c.Close()
+		}
+	}()
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for range b.N {
+		dst, err := pool.Dial(ctx, "tcp", target.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(dst, make([]byte, 1)); err != nil {
+			b.Fatal(err)
+		}
+		dst.Close()
+	}
+}
+
+func TestRelayConfig(t *testing.T) {
+	tests := []struct {
+		size    int
+		want    int
+		wantErr bool
+	}{
+		{0, defaultBufferSize, false},
+		{64 << 10, 64 << 10, false},
+		{1024, 0, true},
+		{32 << 20, 0, true},
+	}
+	for _, tt := range tests {
+		rc := RelayConfig{BufferSize: tt.size}
+		if err := rc.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%d) error = %v, wantErr %v", tt.size, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && rc.bufferSize() != tt.want {
+			t.Errorf("bufferSize() = %d, expected %d", rc.bufferSize(), tt.want)
+		}
+	}
+
+	buf := getBuffer(64 << 10)
+	if len(*buf) != 64<<10 {
+		t.Errorf("getBuffer() returned %d bytes, expected %d", len(*buf), 64<<10)
+	}
+	putBuffer(buf)
+}
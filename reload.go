@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"time"
+)
+
+// configPollInterval is how often the configuration files are checked for
+// changes.
+const configPollInterval = 2 * time.Second
+
+// Reload loads a new configuration and makes it the current one. An invalid
+// configuration is rejected and the current one stays in effect.
+func (s *server) Reload() error {
+	if s.load == nil {
+		return errors.New("reloading is not supported")
+	}
+	cfg, err := s.load()
+	if err != nil {
+		slog.Error("Rejected new configuration, keeping the current one", "error", err)
+		return err
+	}
+
+	sdNotify("RELOADING=1")
+	s.swapConfig(cfg)
+	if err := applyLogLevel(cfg.Log, s.logLevelOverride); err != nil {
+		slog.Warn("Failed to apply log level", "error", err)
+	}
+	sdNotify("READY=1")
+	slog.Info("Configuration reloaded", "proxies", len(cfg.Proxies))
+	return nil
+}
+
+// swapConfig atomically replaces the routing table. Proxies whose SSH chain
+// is unchanged keep their pool, so established tunnels survive the reload,
+// and the pools built for them by the new configuration are closed before
+// ever dialing. The pools of removed or changed proxies are drained once the connections
+// accepted with the old configuration have ended, so that those still being
+// routed can dial through them.
+func (s *server) swapConfig(cfg *Config) {
+	s.cfgMu.Lock()
+	old := s.config()
+
+	for name, proxy := range cfg.Proxies {
+		if prev, ok := old.Proxies[name]; ok && prev.sameChains(proxy) {
+			proxy.pool.Close()
+			proxy.pool = prev.pool
+			cfg.Proxies[name] = proxy
+		}
+	}
+	s.cfg.Store(cfg)
+
+	drain := func() {
+		for name, prev := range old.Proxies {
+			if cur, ok := cfg.Proxies[name]; !ok || cur.pool != prev.pool {
+				slog.Info("Draining SSH connection of removed or changed proxy", "proxy", name)
+				prev.pool.Drain()
+			}
+		}
+	}
+	if old.holds > 0 {
+		old.retire, drain = drain, nil
+	}
+	s.cfgMu.Unlock()
+
+	if drain != nil {
+		drain()
+	}
+
+	// Log files and formats are only set up at startup.
+	if cfg.Log.File != old.Log.File || cfg.Log.Format != old.Log.Format {
+		slog.Warn("New log file or format requires a restart to take effect", "file", cfg.Log.File, "format", cfg.Log.Format)
+	}
+	if cfg.AccessLog != old.AccessLog {
+		slog.Warn("New access log settings require a restart to take effect")
+	}
+
+	// Sockets are only opened at startup.
+	bound := make(map[string]bool, len(s.listeners))
+	for _, ln := range s.listeners {
+		bound[ln.cfg.key()] = true
+	}
+	for _, lc := range cfg.listeners() {
+		if !bound[lc.key()] {
+			slog.Warn("New listener requires a restart to take effect", "address", lc.Addr())
+		}
+	}
+}
+
+// fileStamp is the state of a watched file used to detect changes.
+type fileStamp struct {
+	modTime int64
+	size    int64
+	exists  bool
+}
+
+func statFile(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime().UnixNano(), size: fi.Size(), exists: true}
+}
+
+// statFiles returns the stamps of paths.
+func statFiles(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		stamps[path] = statFile(path)
+	}
+	return stamps
+}
+
+// watchFiles calls onChange whenever one of the files returned by paths is
+// modified, created or removed, or the list of files itself changes, until
+// ctx is done. Files are polled every interval.
+func watchFiles(ctx context.Context, paths func() []string, interval time.Duration, onChange func()) {
+	stamps := statFiles(paths())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := statFiles(paths())
+		if maps.Equal(current, stamps) {
+			continue
+		}
+		for path, stamp := range current {
+			if prev, ok := stamps[path]; !ok || prev != stamp {
+				slog.Debug("Watched file changed", "file", path)
+			}
+		}
+		stamps = current
+		onChange()
+	}
+}
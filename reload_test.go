@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t testing.TB, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	dir := t.TempDir()
+	sshConfig := filepath.Join(dir, "ssh_config")
+	writeTestFile(t, sshConfig, `
+Host bastion1
+    HostName bastion1.example.com
+Host bastion2
+    HostName bastion2.example.com
+Host bastion3
+    HostName bastion3.example.com
+`)
+	t.Setenv("SSH_CONFIG_FILE", sshConfig)
+
+	configPath := filepath.Join(dir, "config.toml")
+	writeTestFile(t, configPath, `
+port = 8080
+
+[proxy.keep]
+host = "bastion1"
+target_addrs = ["a.internal"]
+
+[proxy.change]
+host = "bastion2"
+target_addrs = ["b.internal"]
+
+[proxy.remove]
+host = "bastion3"
+target_addrs = ["c.internal"]
+
+[proxy.pin]
+host = "bastion1"
+target_addrs = ["d.internal"]
+`)
+
+	cfg, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg, nil)
+	old := cfg.Proxies
+	srv.load = runOptions{ConfigPath: configPath}.loadConfig
+
+	writeTestFile(t, configPath, `
+port = 8080
+
+[proxy.keep]
+host = "bastion1"
+target_addrs = ["a.internal", "new.internal"]
+
+[proxy.change]
+host = "bastion3"
+target_addrs = ["b.internal"]
+
+[proxy.pin]
+host = "bastion1"
+target_addrs = ["d.internal"]
+host_key = { fingerprints = ["SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"] }
+`)
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	cur := srv.config().Proxies
+	if cur["keep"].pool != old["keep"].pool {
+		t.Error("expected the unchanged proxy to keep its SSH pool")
+	}
+	if len(cur["keep"].TargetAddrs) != 2 {
+		t.Errorf("expected the new target_addrs to be in effect, got %v", cur["keep"].TargetAddrs)
+	}
+	if cur["change"].pool == old["change"].pool {
+		t.Error("expected the changed proxy to get a new SSH pool")
+	}
+	if cur["pin"].pool == old["pin"].pool {
+		t.Error("expected the proxy with a new host key pin to get a new SSH pool")
+	}
+	if _, ok := cur["remove"]; ok {
+		t.Error("expected the removed proxy to be gone")
+	}
+	for _, name := range []string{"change", "remove", "pin"} {
+		if _, err := old[name].pool.get(context.Background()); err != poolClosedError {
+			t.Errorf("expected the pool of %s to be drained, got %v", name, err)
+		}
+	}
+
+	// The pool a reload builds for an unchanged proxy is closed, not leaked.
+	next, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discarded := next.Proxies["keep"].pool
+	srv.swapConfig(next)
+	if srv.config().Proxies["keep"].pool != old["keep"].pool {
+		t.Error("expected the unchanged proxy to keep its SSH pool")
+	}
+	if !discarded.stats().Closed {
+		t.Error("expected the pool built for the unchanged proxy to be closed")
+	}
+
+	// An invalid configuration is rejected and the current one kept.
+	writeTestFile(t, configPath, `port = "not a number"`)
+	if err := srv.Reload(); err == nil {
+		t.Error("Reload() expected error for an invalid configuration, but got none")
+	}
+	if srv.config().Proxies["keep"].pool != old["keep"].pool {
+		t.Error("expected the current configuration to stay in effect")
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeTestFile(t, path, "port = 8080\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go watchFiles(ctx, func() []string { return []string{path} }, 10*time.Millisecond, func() {
+		changed <- struct{}{}
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	writeTestFile(t, path, "port = 8081\n")
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchFiles() did not report the change")
+	}
+}
+
+func TestSSHConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	sshDir := filepath.Join(dir, ".ssh")
+	main := filepath.Join(sshDir, "config")
+	if err := os.MkdirAll(filepath.Join(sshDir, "conf.d"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, main, `
+Include conf.d/*.conf # relative to ~/.ssh
+Host bastion
+    HostName bastion.example.com
+`)
+	writeTestFile(t, filepath.Join(sshDir, "conf.d", "a.conf"), "Include="+filepath.Join(dir, "nested")+"\n")
+	writeTestFile(t, filepath.Join(sshDir, "conf.d", "b.conf"), "Include "+main+"\n")
+	writeTestFile(t, filepath.Join(dir, "nested"), "Host nested\n")
+
+	expected := []string{
+		main,
+		filepath.Join(sshDir, "conf.d", "a.conf"),
+		filepath.Join(sshDir, "conf.d", "b.conf"),
+		filepath.Join(dir, "nested"),
+	}
+	if got := sshConfigFiles(main); !slices.Equal(got, expected) {
+		t.Errorf("sshConfigFiles() = %v, expected %v", got, expected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go watchFiles(ctx, func() []string { return sshConfigFiles(main) }, 10*time.Millisecond, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	for _, name := range []string{"nested", ".ssh/conf.d/c.conf"} {
+		time.Sleep(50 * time.Millisecond)
+		writeTestFile(t, filepath.Join(dir, name), "Host changed\n")
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watchFiles() did not report the change of included %s", name)
+		}
+	}
+}
+
+func TestReloadKeepsOldPoolForHeldConfig(t *testing.T) {
+	dir := t.TempDir()
+	sshConfig := filepath.Join(dir, "ssh_config")
+	writeTestFile(t, sshConfig, "Host bastion1\n    HostName bastion1.example.com\nHost bastion2\n    HostName bastion2.example.com\n")
+	t.Setenv("SSH_CONFIG_FILE", sshConfig)
+
+	configPath := filepath.Join(dir, "config.toml")
+	writeTestFile(t, configPath, "port = 8080\n[proxy.env1]\nhost = \"bastion1\"\ntarget_addrs = [\"a.internal\"]\n")
+	cfg, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg, nil)
+	srv.load = runOptions{ConfigPath: configPath}.loadConfig
+	oldPool := cfg.Proxies["env1"].pool
+
+	// A connection accepted before the reload, and not yet dialed.
+	held, release := srv.holdConfig()
+
+	writeTestFile(t, configPath, "port = 8080\n[proxy.env1]\nhost = \"bastion2\"\ntarget_addrs = [\"a.internal\"]\n")
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.config() == held {
+		t.Fatal("expected the new configuration to be in effect")
+	}
+	if oldPool.stats().Closed {
+		t.Error("expected the old pool to stay open while a connection routed with it is running")
+	}
+
+	release()
+	if !oldPool.stats().Closed {
+		t.Error("expected the old pool to be drained once the last connection routed with it ended")
+	}
+}
+
+func TestReloadWarnsAboutRestartOnlySettings(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(prev)
+
+	srv := newServer(&Config{ListenPort: 8080}, nil)
+	srv.swapConfig(&Config{ListenPort: 8080})
+	if strings.Contains(buf.String(), "New log") || strings.Contains(buf.String(), "New access log") {
+		t.Errorf("unchanged log settings logged %q", buf.String())
+	}
+
+	srv.swapConfig(&Config{
+		ListenPort: 8080,
+		Log:        LogConfig{Format: logFormatJSON},
+		AccessLog:  AccessLogConfig{File: "/var/log/proxs/access.log"},
+	})
+	for _, msg := range []string{"New log file or format requires a restart", "New access log settings require a restart"} {
+		if !strings.Contains(buf.String(), msg) {
+			t.Errorf("expected %q to be logged, got %q", msg, buf.String())
+		}
+	}
+}
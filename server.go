@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShutdownTimeout is how long active connections may keep running
+// after a shutdown signal when shutdown_timeout is not configured.
+const defaultShutdownTimeout = 30 * time.Second
+
+// server accepts clients on a set of listeners and keeps track of the
+// connections it is handling, so that they can be drained on shutdown.
+type server struct {
+	cfg       atomic.Pointer[Config]
+	cfgMu     sync.Mutex // guards the holds of configurations
+	listeners []boundListener
+
+	// ctx is cancelled to abort the connections still active when the
+	// shutdown deadline expires.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	loops sync.WaitGroup
+	conns sync.WaitGroup
+
+	started   time.Time
+	sessions  sessions
+	admission *admission // read from the configuration at startup
+	admin     *http.Server
+	metrics   *http.Server
+	accessLog *accessLogger
+
+	// load loads a new configuration on reload.
+	load func() (*Config, error)
+	// logLevelOverride is the log level given on the command line, which
+	// takes precedence over the configured one across reloads.
+	logLevelOverride string
+}
+
+func newServer(cfg *Config, listeners []boundListener) *server {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	s := &server{listeners: listeners, ctx: ctx, cancel: cancel, started: time.Now(), admission: newAdmission(cfg.Limits)}
+	s.cfg.Store(cfg)
+	return s
+}
+
+// config returns the configuration currently in effect. It is replaced as
+// a whole on reload, so callers should load it once per connection.
+func (s *server) config() *Config {
+	return s.cfg.Load()
+}
+
+// holdConfig returns the configuration currently in effect, keeping the
+// pools it routes through open until the returned function is called even
+// if a reload replaces it in the meantime.
+func (s *server) holdConfig() (*Config, func()) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	cfg := s.config()
+	cfg.holds++
+	var once sync.Once
+	return cfg, func() {
+		once.Do(func() {
+			s.cfgMu.Lock()
+			cfg.holds--
+			var retire func()
+			if cfg.holds == 0 {
+				retire, cfg.retire = cfg.retire, nil
+			}
+			s.cfgMu.Unlock()
+
+			if retire != nil {
+				retire()
+			}
+		})
+	}
+}
+
+// pools returns the SSH pools of the current configuration.
+func (s *server) pools() []*sshPool {
+	return s.config().pools()
+}
+
+// Serve starts accepting clients on every listener.
+func (s *server) Serve() {
+	for _, ln := range s.listeners {
+		slog.Info("Listening", "network", ln.Addr().Network(), "address", ln.Addr().String(), "protocol", ln.cfg.Protocol)
+
+		s.loops.Add(1)
+		go func() {
+			defer s.loops.Done()
+			s.serve(ln)
+		}()
+	}
+}
+
+// serve accepts clients on ln until it is closed. Each client is routed
+// with the configuration current when it was accepted.
+func (s *server) serve(ln boundListener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Failed to accept connection", "listener", ln.cfg.Addr(), "error", err)
+			continue
+		}
+
+		cfg, release := s.holdConfig()
+		lc := cfg.listenerFor(ln.cfg)
+
+		if !lc.allowsClient(conn.RemoteAddr()) {
+			release()
+			metrics.clientsRejected.with("not_allowed").Inc()
+			slog.Warn("Rejecting client connection, address not allowed", "listener", ln.cfg.Addr(), "client", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		if !s.admission.enter() {
+			release()
+			metrics.clientsRejected.with("queue_full").Inc()
+			slog.Warn("Rejecting client connection, too many clients waiting", "listener", ln.cfg.Addr(), "client", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		sess, ctx := s.sessions.add(s.ctx, conn, ln.Addr().String())
+
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			defer release()
+			defer s.sessions.remove(sess)
+
+			slog.DebugContext(ctx, "Connection accepted", "listener", sess.Listener)
+			if release, err := s.admission.wait(ctx); err != nil {
+				metrics.clientsRejected.with("queue_timeout").Inc()
+				sess.setCloseReason(closeRejected)
+				slog.WarnContext(ctx, "Rejecting client connection", "error", err)
+				conn.Close()
+			} else {
+				handleConnection(ctx, sess, conn, cfg, lc)
+				release()
+			}
+
+			rec := sess.accessRecord()
+			slog.DebugContext(ctx, "Connection closed", "reason", rec.CloseReason, "bytes_out", rec.BytesOut, "bytes_in", rec.BytesIn, "duration", rec.Duration)
+			if s.accessLog != nil {
+				s.accessLog.Log(rec)
+			}
+		}()
+	}
+}
+
+// Shutdown stops accepting clients and waits up to timeout for active
+// connections to finish before aborting them. The SSH connections of every
+// proxy are closed once no stream uses them anymore.
+func (s *server) Shutdown(timeout time.Duration) {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.loops.Wait()
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	if s.metrics != nil {
+		s.metrics.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("Shutdown timeout exceeded, closing remaining connections", "timeout", timeout)
+		s.cancel(shutdownTimeoutError)
+		<-done
+	}
+	s.cancel(nil)
+
+	for _, p := range s.pools() {
+		p.Close()
+	}
+	if s.accessLog != nil {
+		s.accessLog.Close()
+	}
+}
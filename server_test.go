@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*server, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Proxies: map[string]sshProxy{}}
+	lc := ListenerConfig{Address: "127.0.0.1", Protocol: protocolSOCKS5}
+	srv := newServer(cfg, []boundListener{{ln, lc}})
+	srv.Serve()
+	return srv, ln.Addr().String()
+}
+
+func TestServerShutdownAbortsStalledConnections(t *testing.T) {
+	srv, addr := newTestServer(t)
+
+	// A client that connects but never sends its greeting.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the connection to be accepted.
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown(100 * time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown() did not abort the stalled connection")
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("expected the listener to be closed after Shutdown()")
+	}
+}
+
+func TestServerShutdownWaitsForConnections(t *testing.T) {
+	srv, addr := newTestServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown(time.Minute)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown() returned while a connection was still active")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Sending an invalid greeting ends the connection.
+	conn.Write([]byte{4, 1, 0})
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown() did not return after the connection finished")
+	}
+}
+
+func TestSocksConnectionCancelled(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := socksConnection(ctx, server, nil)
+		errChan <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Error("socksConnection() expected error after cancellation, but got none")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("socksConnection() was not aborted by its context")
+	}
+}
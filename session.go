@@ -0,0 +1,263 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session is a client connection handled by the server. The destination
+// fields are filled in as the connection progresses through the handshake
+// and routing.
+type session struct {
+	ID       uint64
+	Client   net.Addr
+	Listener string
+	Started  time.Time
+
+	cancel context.CancelCauseFunc
+
+	mu          sync.Mutex
+	dest        string
+	user        string
+	proxy       string
+	rule        string
+	chain       []string
+	closeReason string
+
+	bytesOut atomic.Int64 // client to destination
+	bytesIn  atomic.Int64 // destination to client
+
+	lastActive atomic.Int64 // Unix nanoseconds of the last relayed bytes
+}
+
+// Reasons for which a session ends, as reported in the access log.
+const (
+	closeRejected        = "rejected"
+	closeHandshakeFailed = "handshake_failed"
+	closeNoRoute         = "no_route"
+	closeDenied          = "denied"
+	closeDialFailed      = "dial_failed"
+	closeClient          = "client_closed"
+	closeDestination     = "destination_closed"
+	closeKilled          = "killed"
+	closeIdle            = "idle_timeout"
+	closeExpired         = "max_lifetime"
+	closeShutdown        = "shutdown"
+	closeAborted         = "aborted"
+)
+
+var sessionKilledError = errors.New("connection killed through admin endpoint")
+var shutdownTimeoutError = errors.New("server shutdown timeout exceeded")
+
+// closeReasonFor returns the close reason of a session whose context was
+// cancelled with cause.
+func closeReasonFor(cause error) string {
+	switch {
+	case errors.Is(cause, sessionKilledError):
+		return closeKilled
+	case errors.Is(cause, shutdownTimeoutError):
+		return closeShutdown
+	case errors.Is(cause, idleTimeoutError):
+		return closeIdle
+	case errors.Is(cause, sessionExpiredError):
+		return closeExpired
+	}
+	return closeAborted
+}
+
+// accessRecord summarises the session for the access log once it is closed.
+func (sess *session) accessRecord() accessRecord {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return accessRecord{
+		Time:        sess.Started,
+		ConnID:      sess.ID,
+		Client:      sess.Client.String(),
+		Listener:    sess.Listener,
+		User:        sess.user,
+		Destination: sess.dest,
+		Rule:        sess.rule,
+		Proxy:       sess.proxy,
+		Chain:       sess.chain,
+		BytesOut:    sess.bytesOut.Load(),
+		BytesIn:     sess.bytesIn.Load(),
+		Duration:    time.Since(sess.Started),
+		CloseReason: cmp.Or(sess.closeReason, closeAborted),
+	}
+}
+
+// sessionInfo is a snapshot of a session as reported by the admin endpoint.
+type sessionInfo struct {
+	ID          uint64    `json:"id"`
+	Client      string    `json:"client"`
+	Listener    string    `json:"listener"`
+	User        string    `json:"user,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Proxy       string    `json:"proxy,omitempty"`
+	Rule        string    `json:"rule,omitempty"`
+	Chain       []string  `json:"chain,omitempty"`
+	BytesOut    int64     `json:"bytes_out"`
+	BytesIn     int64     `json:"bytes_in"`
+	Started     time.Time `json:"started"`
+	Age         string    `json:"age"`
+}
+
+func (sess *session) setRequest(req clientRequest) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.dest = req.Addr()
+	sess.user = req.User
+}
+
+// setRoute records the proxy a session is routed through and the
+// target_addrs pattern that selected it.
+func (sess *session) setRoute(proxy sshProxy, rule string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.proxy = proxy.Name
+	sess.rule = rule
+	sess.chain = chainStrings(proxy.Connection)
+}
+
+// setChain records the hops a session's stream was opened through, which
+// differ from the proxy's first chain after a failover.
+func (sess *session) setChain(chain []string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.chain = chain
+}
+
+// setCloseReason records why a session ended. Only the first reason is
+// kept, as closing one side of a connection makes the other side fail too.
+func (sess *session) setCloseReason(reason string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closeReason == "" {
+		sess.closeReason = reason
+	}
+}
+
+func (sess *session) getCloseReason() string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.closeReason
+}
+
+func (sess *session) info() sessionInfo {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sessionInfo{
+		ID:          sess.ID,
+		Client:      sess.Client.String(),
+		Listener:    sess.Listener,
+		User:        sess.user,
+		Destination: sess.dest,
+		Proxy:       sess.proxy,
+		Rule:        sess.rule,
+		Chain:       sess.chain,
+		BytesOut:    sess.bytesOut.Load(),
+		BytesIn:     sess.bytesIn.Load(),
+		Started:     sess.Started,
+		Age:         time.Since(sess.Started).Round(time.Second).String(),
+	}
+}
+
+// sessions keeps track of the active sessions of a server.
+type sessions struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*session
+}
+
+// add registers a session for conn, whose context is derived from ctx.
+func (ss *sessions) add(ctx context.Context, conn net.Conn, listener string) (*session, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.nextID++
+	ctx = withLogAttrs(ctx, slog.Uint64("conn_id", ss.nextID), slog.String("client", conn.RemoteAddr().String()))
+	sess := &session{
+		ID:       ss.nextID,
+		Client:   conn.RemoteAddr(),
+		Listener: listener,
+		Started:  time.Now(),
+		cancel:   cancel,
+	}
+	if ss.active == nil {
+		ss.active = make(map[uint64]*session)
+	}
+	ss.active[sess.ID] = sess
+	return sess, ctx
+}
+
+func (ss *sessions) remove(sess *session) {
+	sess.cancel(nil)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.active, sess.ID)
+}
+
+func (ss *sessions) count() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.active)
+}
+
+// list returns a snapshot of the active sessions, oldest first.
+func (ss *sessions) list() []sessionInfo {
+	ss.mu.Lock()
+	active := make([]*session, 0, len(ss.active))
+	for _, sess := range ss.active {
+		active = append(active, sess)
+	}
+	ss.mu.Unlock()
+
+	infos := make([]sessionInfo, 0, len(active))
+	for _, sess := range active {
+		infos = append(infos, sess.info())
+	}
+	slices.SortFunc(infos, func(a, b sessionInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return infos
+}
+
+// kill aborts the session with the given ID. It reports whether such a
+// session was active.
+func (ss *sessions) kill(id uint64) bool {
+	ss.mu.Lock()
+	sess, ok := ss.active[id]
+	ss.mu.Unlock()
+
+	if ok {
+		sess.cancel(sessionKilledError)
+	}
+	return ok
+}
+
+// countingWriter counts the bytes written through it, both for the session
+// and in the metric of the proxy, and records when the session was last
+// active.
+type countingWriter struct {
+	w      io.Writer
+	n      *atomic.Int64
+	total  *series
+	active *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	cw.total.Add(float64(n))
+	cw.active.Store(time.Now().UnixNano())
+	return n, err
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBurst is the smallest burst of a token bucket, so that slow limits
+// still let a whole relay buffer through at once.
+const minBurst = 64 << 10
+
+// defaultInteractivePorts are the destination ports whose connections take
+// precedence over bulk transfers: SSH and RDP.
+var defaultInteractivePorts = []int{22, 3389}
+
+// RateLimit bounds the bytes per second sent to destinations (Upload) and
+// to clients (Download). Rates are written like "10MiB", "500k" or
+// "1000000", optionally followed by "/s"; an empty rate is unlimited.
+type RateLimit struct {
+	Upload   string `toml:"upload"`
+	Download string `toml:"download"`
+}
+
+func (rl RateLimit) validate() error {
+	if _, err := parseRate(rl.Upload); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	if _, err := parseRate(rl.Download); err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+	return nil
+}
+
+// buckets returns the token buckets enforcing the limit in each direction;
+// a bucket is nil when that direction is unlimited. rl must be valid.
+func (rl RateLimit) buckets() (up, down *tokenBucket) {
+	upRate, _ := parseRate(rl.Upload)
+	downRate, _ := parseRate(rl.Download)
+	return newTokenBucket(upRate), newTokenBucket(downRate)
+}
+
+// parseRate parses a rate in bytes per second. Suffixes k, M and G are
+// powers of 1000, Ki, Mi and Gi powers of 1024; a trailing "B" is allowed.
+func parseRate(s string) (float64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if s == "" {
+		return 0, nil
+	}
+	num := strings.TrimSuffix(s, "B")
+	mult := 1.0
+	for _, unit := range []struct {
+		suffix string
+		mult   float64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30},
+		{"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9},
+	} {
+		if strings.HasSuffix(num, unit.suffix) {
+			num, mult = strings.TrimSuffix(num, unit.suffix), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n * mult, nil
+}
+
+// LimitsConfig holds the limits applied to each client address, and the
+// destination ports whose connections take precedence over bulk transfers.
+// MaxClients caps the clients handled at once; AcceptQueue more may wait
+// up to AcceptQueueTimeout for one of them to finish.
+type LimitsConfig struct {
+	Client             RateLimit     `toml:"client"`
+	InteractivePorts   []int         `toml:"interactive_ports"`
+	MaxClients         int           `toml:"max_clients"`
+	AcceptQueue        *int          `toml:"accept_queue"`
+	AcceptQueueTimeout time.Duration `toml:"accept_queue_timeout"`
+}
+
+func (lc LimitsConfig) validate() error {
+	if err := lc.Client.validate(); err != nil {
+		return fmt.Errorf("client limit: %w", err)
+	}
+	if lc.MaxClients < 0 || lc.AcceptQueueTimeout < 0 || (lc.AcceptQueue != nil && *lc.AcceptQueue < 0) {
+		return fmt.Errorf("max_clients, accept_queue and accept_queue_timeout cannot be negative")
+	}
+	for _, port := range lc.InteractivePorts {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid interactive port %d", port)
+		}
+	}
+	return nil
+}
+
+// interactive reports whether connections to port take precedence.
+func (lc LimitsConfig) interactive(port uint16) bool {
+	ports := lc.InteractivePorts
+	if ports == nil {
+		ports = defaultInteractivePorts
+	}
+	return slices.Contains(ports, int(port))
+}
+
+// tokenBucket limits a byte stream to rate bytes per second, with bursts of
+// up to burst bytes. Bulk traffic leaves reserve tokens to priority traffic.
+type tokenBucket struct {
+	rate    float64
+	burst   float64
+	reserve float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket of rate bytes per second, or nil
+// when rate is zero, which is unlimited.
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	burst := max(rate, minBurst)
+	return &tokenBucket{rate: rate, burst: burst, reserve: burst / 4, tokens: burst, last: time.Now()}
+}
+
+// refill adds the tokens accumulated since the last call. b.mu must be held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+}
+
+// take removes n tokens from the bucket and returns how long the caller
+// must wait before sending them. The bucket may go into debt, which the
+// caller waits for, so that no traffic exceeds the rate.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bulkWait returns how long bulk traffic must wait until n tokens are
+// available above the reserve, without taking them. Bulk traffic thus never
+// goes into debt that priority traffic would queue behind, and the reserve
+// lets priority traffic through at once.
+func (b *tokenBucket) bulkWait(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	missing := b.reserve + float64(n) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.rate * float64(time.Second))
+}
+
+// shaper applies the rate limits of a connection in one direction.
+type shaper struct {
+	buckets  []*tokenBucket
+	priority bool
+}
+
+// add adds the limits of b, which may be nil.
+func (s *shaper) add(b *tokenBucket) {
+	if b != nil {
+		s.buckets = append(s.buckets, b)
+	}
+}
+
+// writer returns w throttled by the limits, or w itself when there are
+// none.
+func (s shaper) writer(ctx context.Context, w io.Writer) io.Writer {
+	if len(s.buckets) == 0 {
+		return w
+	}
+	chunk := math.MaxInt
+	for _, b := range s.buckets {
+		chunk = min(chunk, int(b.burst-b.reserve))
+	}
+	return &shapedWriter{ctx: ctx, w: w, shaper: s, chunk: chunk}
+}
+
+// shapedWriter writes in chunks that fit in any burst beside its reserve,
+// waiting before each for the tokens of every bucket. Bulk chunks wait
+// until every bucket has their tokens to spare before taking them.
+type shapedWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	shaper shaper
+	chunk  int
+}
+
+func (sw *shapedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), sw.chunk)
+		for !sw.shaper.priority {
+			var delay time.Duration
+			for _, b := range sw.shaper.buckets {
+				delay = max(delay, b.bulkWait(n))
+			}
+			if delay == 0 {
+				break
+			}
+			if err := sw.wait(delay); err != nil {
+				return written, err
+			}
+		}
+		var delay time.Duration
+		for _, b := range sw.shaper.buckets {
+			delay = max(delay, b.take(n))
+		}
+		if delay > 0 {
+			if err := sw.wait(delay); err != nil {
+				return written, err
+			}
+		}
+		m, err := sw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// wait sleeps for delay, or until the context of the connection is done.
+func (sw *shapedWriter) wait(delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-sw.ctx.Done():
+		return context.Cause(sw.ctx)
+	case <-timer.C:
+		return nil
+	}
+}
+
+// proxyLimits holds the buckets shared by the connections through a proxy,
+// for the proxy as a whole and for each of its limited routes.
+type proxyLimits struct {
+	up, down *tokenBucket
+	routes   map[string][2]*tokenBucket
+}
+
+// newProxyLimits returns the buckets of sp, or nil when it has no limits.
+func newProxyLimits(sp sshProxy) *proxyLimits {
+	if sp.Limits == (RateLimit{}) && len(sp.RouteLimits) == 0 {
+		return nil
+	}
+	pl := &proxyLimits{routes: make(map[string][2]*tokenBucket)}
+	pl.up, pl.down = sp.Limits.buckets()
+	for pattern, rl := range sp.RouteLimits {
+		up, down := rl.buckets()
+		pl.routes[pattern] = [2]*tokenBucket{up, down}
+	}
+	return pl
+}
+
+// clientLimits holds the buckets of each client address with an open
+// connection. A client's buckets are dropped with its last connection.
+type clientLimits struct {
+	limit RateLimit
+
+	mu      sync.Mutex
+	clients map[string]*clientBuckets
+}
+
+type clientBuckets struct {
+	up, down *tokenBucket
+	refs     int
+}
+
+func newClientLimits(limit RateLimit) *clientLimits {
+	return &clientLimits{limit: limit, clients: make(map[string]*clientBuckets)}
+}
+
+// acquire returns the buckets of the client at addr and a function
+// releasing them.
+func (cl *clientLimits) acquire(addr net.Addr) (up, down *tokenBucket, release func()) {
+	if cl == nil || cl.limit == (RateLimit{}) {
+		return nil, nil, func() {}
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cb, ok := cl.clients[host]
+	if !ok {
+		cb = &clientBuckets{}
+		cb.up, cb.down = cl.limit.buckets()
+		cl.clients[host] = cb
+	}
+	cb.refs++
+	return cb.up, cb.down, func() {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		if cb.refs--; cb.refs == 0 {
+			delete(cl.clients, host)
+		}
+	}
+}
+
+// shapersFor returns the upload and download shapers of a connection
+// from client to port through sp, matched by rule. The returned function
+// releases the client's buckets once the connection is closed.
+func (c *Config) shapersFor(client net.Addr, sp sshProxy, rule string, port uint16) (up, down shaper, release func()) {
+	priority := c.Limits.interactive(port)
+	up.priority, down.priority = priority, priority
+
+	cup, cdown, release := c.clientLimits.acquire(client)
+	up.add(cup)
+	down.add(cdown)
+	if pl := sp.limits; pl != nil {
+		up.add(pl.up)
+		down.add(pl.down)
+		if rb, ok := pl.routes[rule]; ok {
+			up.add(rb[0])
+			down.add(rb[1])
+		}
+	}
+	return up, down, release
+}
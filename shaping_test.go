@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"1000", 1000, false},
+		{"500k", 500e3, false},
+		{"10MiB", 10 << 20, false},
+		{"10MB/s", 10e6, false},
+		{"1.5Gi", 1.5 * (1 << 30), false},
+		{"fast", 0, true},
+		{"-1M", 0, true},
+		{"0", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRate(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRate(%q) = %v, expected %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(50e3)
+	if b.burst != minBurst {
+		t.Errorf("burst = %v, expected %v", b.burst, minBurst)
+	}
+	if d := b.take(minBurst); d != 0 {
+		t.Errorf("take() within the burst = %v, expected no wait", d)
+	}
+	if d := b.take(25e3); d < 400*time.Millisecond || d > 600*time.Millisecond {
+		t.Errorf("take() beyond the burst = %v, expected about 500ms", d)
+	}
+
+	// Bulk traffic leaves the reserve to priority traffic, which is still
+	// held to the rate once the bucket is empty.
+	b = newTokenBucket(50e3)
+	if d := b.bulkWait(minBurst - minBurst/4); d != 0 {
+		t.Errorf("bulkWait() above the reserve = %v, expected no wait", d)
+	}
+	b.take(minBurst - minBurst/4)
+	if d := b.bulkWait(1); d == 0 {
+		t.Error("bulkWait() within the reserve, expected a wait")
+	}
+	if d := b.take(minBurst / 4); d != 0 {
+		t.Errorf("priority take() of the reserve = %v, expected no wait", d)
+	}
+	if d := b.take(25e3); d < 400*time.Millisecond || d > 600*time.Millisecond {
+		t.Errorf("priority take() beyond the burst = %v, expected about 500ms", d)
+	}
+	if d := b.bulkWait(1); d < 800*time.Millisecond {
+		t.Errorf("bulkWait() after priority debt = %v, expected to wait for the debt and the reserve", d)
+	}
+
+	if newTokenBucket(0) != nil {
+		t.Error("newTokenBucket(0) should be unlimited")
+	}
+}
+
+func TestShapedWriter(t *testing.T) {
+	var s shaper
+	s.add(newTokenBucket(50e3))
+	w := s.writer(context.Background(), io.Discard)
+
+	start := time.Now()
+	n, err := w.Write(make([]byte, minBurst+25e3))
+	if err != nil || n != minBurst+25e3 {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Write() took %v, expected at least 500ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.writer(ctx, io.Discard).Write(make([]byte, 25e3)); err == nil {
+		t.Error("Write() on a cancelled context should fail while waiting")
+	}
+
+	// Priority traffic is not held back by the reserve, but stays within
+	// the rate.
+	priority := shaper{priority: true}
+	priority.add(newTokenBucket(50e3))
+	start = time.Now()
+	if _, err := priority.writer(context.Background(), io.Discard).Write(make([]byte, minBurst+50e3)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("priority Write() took %v, expected about 1s", elapsed)
+	}
+
+	if w := (shaper{}).writer(context.Background(), io.Discard); w != io.Discard {
+		t.Error("writer() without limits should return the writer itself")
+	}
+}
+
+func TestShapersFor(t *testing.T) {
+	sp := sshProxy{
+		Name:        "env1",
+		TargetAddrs: []string{"*.internal", "registry.example.com"},
+		Limits:      RateLimit{Upload: "10M", Download: "50M"},
+		RouteLimits: map[string]RateLimit{"registry.example.com": {Download: "5M"}},
+	}
+	sp.limits = newProxyLimits(sp)
+	cfg := &Config{Limits: LimitsConfig{Client: RateLimit{Download: "1M"}}}
+	cfg.clientLimits = newClientLimits(cfg.Limits.Client)
+
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	up, down, release := cfg.shapersFor(client, sp, "registry.example.com", 443)
+	if len(up.buckets) != 1 || len(down.buckets) != 3 || up.priority {
+		t.Errorf("registry route: %d upload and %d download buckets (priority %v), expected 1 and 3", len(up.buckets), len(down.buckets), up.priority)
+	}
+
+	// Connections from the same address share its buckets.
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40001}
+	_, down2, release2 := cfg.shapersFor(other, sp, "*.internal", 22)
+	if !down2.priority {
+		t.Error("connections to port 22 should have priority")
+	}
+	if len(down2.buckets) != 2 || down2.buckets[0] != down.buckets[0] {
+		t.Errorf("the client buckets are not shared between connections")
+	}
+
+	release()
+	release2()
+	if n := len(cfg.clientLimits.clients); n != 0 {
+		t.Errorf("%d clients left after their connections were released", n)
+	}
+
+	// Without limits nothing is shaped.
+	up, down, release = (&Config{}).shapersFor(client, sshProxy{Name: "env2"}, "*", 443)
+	defer release()
+	if len(up.buckets) != 0 || len(down.buckets) != 0 {
+		t.Error("expected no buckets without limits")
+	}
+}
+
+func TestProxyLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sp      sshProxy
+		wantErr bool
+	}{
+		{"valid", sshProxy{Host: "h", TargetAddrs: []string{"a"}, Limits: RateLimit{Upload: "1M"}, RouteLimits: map[string]RateLimit{"a": {Download: "1M"}}}, false},
+		{"invalid rate", sshProxy{Host: "h", Limits: RateLimit{Upload: "lots"}}, true},
+		{"unknown route", sshProxy{Host: "h", TargetAddrs: []string{"a"}, RouteLimits: map[string]RateLimit{"b": {Download: "1M"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.sp.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if err := (LimitsConfig{InteractivePorts: []int{0}}).validate(); err == nil {
+		t.Error("expected an error for port 0")
+	}
+	if (LimitsConfig{InteractivePorts: []int{5900}}).interactive(22) {
+		t.Error("configured interactive ports should replace the defaults")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+var socks4FieldTooLongError = errors.New("SOCKS4 user ID or hostname too long")
+
+const (
+	// maxSocks4Field bounds the NUL-terminated user ID and hostname, which
+	// the protocol leaves unbounded.
+	maxSocks4Field = 255
+)
+
+// https://www.openssh.com/txt/socks4.protocol
+//
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	  1    1      2              4           variable       1
+//
+// With SOCKS4a (https://www.openssh.com/txt/socks4a.protocol), a DSTIP of
+// 0.0.0.x with x non-zero is followed by a NUL-terminated hostname, which
+// is then the destination.
+type Socks4Request struct {
+	Ver      byte
+	Command  byte
+	DestPort uint16
+	DestIP   [4]byte
+	UserID   string
+	DestAddr string
+}
+
+// socks4a reports whether ip is a SOCKS4a placeholder announcing a hostname.
+func socks4a(ip [4]byte) bool {
+	return ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
+}
+
+func ParseSocks4Request(r io.Reader) (Socks4Request, error) {
+	var req Socks4Request
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return req, err
+	}
+	req.Ver = buf[0]
+	req.Command = buf[1]
+	req.DestPort = uint16(buf[2])<<8 | uint16(buf[3])
+	copy(req.DestIP[:], buf[4:])
+
+	if req.Ver != 4 {
+		return Socks4Request{}, unsupportedSocksVersionError
+	}
+	// Only the CONNECT command is supported.
+	if req.Command != 1 {
+		return Socks4Request{}, unsupportedCommandError
+	}
+
+	userID, err := readNulTerminated(r)
+	if err != nil {
+		return Socks4Request{}, err
+	}
+	req.UserID = userID
+
+	if socks4a(req.DestIP) {
+		host, err := readNulTerminated(r)
+		if err != nil {
+			return Socks4Request{}, err
+		}
+		req.DestAddr = host
+	} else {
+		req.DestAddr = net.IP(req.DestIP[:]).String()
+	}
+	return req, nil
+}
+
+// readNulTerminated reads a string of at most maxSocks4Field bytes followed
+// by a NUL byte. It reads one byte at a time so that nothing after the NUL
+// is consumed.
+func readNulTerminated(r io.Reader) (string, error) {
+	var s []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) == maxSocks4Field {
+			return "", socks4FieldTooLongError
+		}
+		s = append(s, b[0])
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSocks4Request(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		expected Socks4Request
+		err      error
+	}{
+		{
+			name: "SOCKS4 with IPv4",
+			// VN=4, CD=1, DSTPORT=443, DSTIP=10.0.0.1, USERID="bob"
+			input:    []byte{4, 1, 1, 187, 10, 0, 0, 1, 'b', 'o', 'b', 0},
+			expected: Socks4Request{Ver: 4, Command: 1, DestPort: 443, DestIP: [4]byte{10, 0, 0, 1}, UserID: "bob", DestAddr: "10.0.0.1"},
+		},
+		{
+			name: "SOCKS4a with hostname",
+			// VN=4, CD=1, DSTPORT=80, DSTIP=0.0.0.1, USERID="", host="example.com"
+			input:    append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com\x00"...),
+			expected: Socks4Request{Ver: 4, Command: 1, DestPort: 80, DestIP: [4]byte{0, 0, 0, 1}, DestAddr: "example.com"},
+		},
+		{
+			name:  "Invalid version",
+			input: []byte{5, 1, 0, 80, 10, 0, 0, 1, 0},
+			err:   unsupportedSocksVersionError,
+		},
+		{
+			name:  "BIND command",
+			input: []byte{4, 2, 0, 80, 10, 0, 0, 1, 0},
+			err:   unsupportedCommandError,
+		},
+		{
+			name:  "User ID too long",
+			input: append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, bytes.Repeat([]byte{'a'}, maxSocks4Field+1)...),
+			err:   socks4FieldTooLongError,
+		},
+		{
+			name:  "Missing hostname terminator",
+			input: append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com"...),
+			err:   io.EOF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseSocks4Request(bytes.NewReader(tt.input))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("ParseSocks4Request() error = %v, expected %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSocks4Request() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("ParseSocks4Request() = %+v, expected %+v", result, tt.expected)
+			}
+		})
+	}
+}
+
+// SOCKS4 cannot authenticate clients, so proxs only parses it for the fuzz
+// target and does not serve it on any listener.
+func TestSocks4NotServed(t *testing.T) {
+	request := append([]byte{4, 1, 0, 22, 0, 0, 0, 1, 0}, "example.com\x00"...)
+
+	for _, protocol := range []string{protocolSOCKS5, protocolMixed} {
+		server, client := net.Pipe()
+		go client.Write(request)
+		if req, err := negotiate(context.Background(), newBufferedConn(server), ListenerConfig{Protocol: protocol}, 100*time.Millisecond); err == nil {
+			t.Errorf("%s listener served SOCKS4 request %+v", protocol, req)
+		}
+		server.Close()
+		client.Close()
+	}
+}
@@ -1,105 +1,310 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+var noMatchingProxyError = errors.New("no matching proxy found")
+
 type sshConnection struct {
 	HostName string
 	User     string
 	Port     int
 	JumpHost *sshConnection
+
+	// ServerAliveInterval and ServerAliveCountMax come from ssh_config;
+	// see keepAlive.
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+
+	// ConnectTimeout bounds the TCP connection and SSH handshake with the
+	// hop; zero means no bound.
+	ConnectTimeout time.Duration
+
+	// Ciphers come from ssh_config; nil keeps the crypto/ssh defaults.
+	Ciphers []string
+
+	// HostKey comes from the host_key of the proxy the hop belongs to; nil
+	// accepts any host key.
+	HostKey *HostKeyPin
 }
 
+// sshProxy routes the destinations matching TargetAddrs through the SSH
+// host Host, or through one of Hosts as chosen by Failover. Connection is
+// the chain of the first host, Connections those of all of them. PoolSize
+// chains are kept open and streams spread across them as set by Balance.
+// Limits bounds the traffic of all its connections together, and
+// RouteLimits that of the connections matching a pattern of TargetAddrs.
+// MaxStreams caps its open streams and MaxStreamsPerConnection those of
+// each chain, for bastions enforcing MaxSessions; requests beyond the caps
+// wait up to QueueTimeout. ACL restricts the destinations it connects to,
+// on top of the global ACL.
 type sshProxy struct {
-	Host        string   `toml:"host"`
-	TargetAddrs []string `toml:"target_addrs"`
-	Connection  *sshConnection
+	Name                    string               `toml:"-"`
+	Host                    string               `toml:"host"`
+	Hosts                   []string             `toml:"hosts"`
+	Failover                FailoverConfig       `toml:"failover"`
+	PoolSize                int                  `toml:"connections"`
+	Balance                 string               `toml:"balance"`
+	MaxStreams              int                  `toml:"max_streams"`
+	MaxStreamsPerConnection int                  `toml:"max_streams_per_connection"`
+	QueueTimeout            time.Duration        `toml:"queue_timeout"`
+	TargetAddrs             []string             `toml:"target_addrs"`
+	Limits                  RateLimit            `toml:"limits"`
+	RouteLimits             map[string]RateLimit `toml:"route_limits"`
+	ACL                     ACL                  `toml:"acl"`
+	HostKey                 HostKeyPin           `toml:"host_key"`
+	Connection              *sshConnection       `toml:"-"`
+	Connections             []*sshConnection     `toml:"-"`
+	pool                    *sshPool
+	limits                  *proxyLimits
+
+	// channelOpenTimeout comes from the [timeouts] section.
+	channelOpenTimeout time.Duration
+}
+
+// hosts returns the ssh_config hosts of the proxy.
+func (sp sshProxy) hosts() []string {
+	if len(sp.Hosts) > 0 {
+		return sp.Hosts
+	}
+	return []string{sp.Host}
+}
+
+func (sp sshProxy) validate() error {
+	if (sp.Host == "") == (len(sp.Hosts) == 0) {
+		return fmt.Errorf("proxy %s: exactly one of host and hosts must be set", sp.Name)
+	}
+	if err := sp.Failover.validate(len(sp.hosts())); err != nil {
+		return fmt.Errorf("proxy %s: %w", sp.Name, err)
+	}
+	if sp.PoolSize < 0 {
+		return fmt.Errorf("proxy %s: connections cannot be negative", sp.Name)
+	}
+	switch sp.Balance {
+	case "", balanceLeastStreams, balanceRoundRobin:
+	default:
+		return fmt.Errorf("proxy %s: unknown balance %q", sp.Name, sp.Balance)
+	}
+	if sp.MaxStreams < 0 || sp.MaxStreamsPerConnection < 0 || sp.QueueTimeout < 0 {
+		return fmt.Errorf("proxy %s: max_streams, max_streams_per_connection and queue_timeout cannot be negative", sp.Name)
+	}
+	if err := sp.Limits.validate(); err != nil {
+		return fmt.Errorf("proxy %s: limits: %w", sp.Name, err)
+	}
+	for pattern, rl := range sp.RouteLimits {
+		if !slices.Contains(sp.TargetAddrs, pattern) {
+			return fmt.Errorf("proxy %s: route limit for %q, which is not in target_addrs", sp.Name, pattern)
+		}
+		if err := rl.validate(); err != nil {
+			return fmt.Errorf("proxy %s: route limit for %q: %w", sp.Name, pattern, err)
+		}
+	}
+	if err := sp.ACL.validate(); err != nil {
+		return fmt.Errorf("proxy %s: acl: %w", sp.Name, err)
+	}
+	if err := sp.HostKey.validate(); err != nil {
+		return fmt.Errorf("proxy %s: host_key: %w", sp.Name, err)
+	}
+	return nil
+}
+
+// sameChains reports whether sp and other dial the same hosts the same way,
+// in which case a pool built for one can be used for the other.
+func (sp sshProxy) sameChains(other sshProxy) bool {
+	return slices.EqualFunc(sp.Connections, other.Connections, (*sshConnection).Equal) &&
+		sp.Failover.Equal(other.Failover) &&
+		sp.PoolSize == other.PoolSize &&
+		sp.Balance == other.Balance &&
+		sp.channelOpenTimeout == other.channelOpenTimeout &&
+		sp.MaxStreams == other.MaxStreams &&
+		sp.MaxStreamsPerConnection == other.MaxStreamsPerConnection &&
+		sp.QueueTimeout == other.QueueTimeout
 }
 
-func sshProxySelectFrom(addr string, proxies []sshProxy) (sshProxy, error) {
+func sshProxySelectFrom(ctx context.Context, addr string, proxies []sshProxy) (sshProxy, error) {
+	proxy, _, err := sshProxyRouteFrom(ctx, addr, proxies)
+	return proxy, err
+}
+
+// sshProxyRouteFrom is sshProxySelectFrom that also returns the
+// target_addrs pattern that matched addr.
+func sshProxyRouteFrom(ctx context.Context, addr string, proxies []sshProxy) (sshProxy, string, error) {
 	for _, proxy := range proxies {
 		for _, targetAddr := range proxy.TargetAddrs {
 			match, err := filepath.Match(targetAddr, addr)
 			if err != nil {
-				slog.Error("Error matching domain with target address", "domain", addr, "targetAddr", targetAddr, "error", err)
-				return sshProxy{}, err
+				slog.ErrorContext(ctx, "Error matching domain with target address", "domain", addr, "targetAddr", targetAddr, "error", err)
+				return sshProxy{}, "", err
 			}
 			if match {
-				slog.Info("Matched proxy for domain", "domain", addr, "address", proxy)
-				return proxy, nil
+				slog.DebugContext(ctx, "Matched proxy for domain", "domain", addr, "proxy", proxy.Name, "targetAddr", targetAddr)
+				return proxy, targetAddr, nil
 			}
 		}
 	}
-	slog.Warn("No proxy found for domain", "domain", addr)
-	return sshProxy{}, fmt.Errorf("no matching proxy found for address: %s", addr)
+	return sshProxy{}, "", fmt.Errorf("%w for address: %s", noMatchingProxyError, addr)
+}
+
+// String returns the hop as user@host:port.
+func (sc *sshConnection) String() string {
+	return fmt.Sprintf("%s@%s", sc.User, net.JoinHostPort(sc.HostName, strconv.Itoa(sc.Port)))
+}
+
+// Chain returns the hops of the connection in the order they are dialed,
+// from the outermost jump host to sc itself.
+func (sc *sshConnection) Chain() []*sshConnection {
+	if sc.JumpHost == nil {
+		return []*sshConnection{sc}
+	}
+	return append(sc.JumpHost.Chain(), sc)
+}
+
+// Equal reports whether sc and other describe the same chain of hops, in
+// which case a client dialed for one can be used for the other.
+func (sc *sshConnection) Equal(other *sshConnection) bool {
+	if sc == nil || other == nil {
+		return sc == other
+	}
+	return sc.HostName == other.HostName &&
+		sc.User == other.User &&
+		sc.Port == other.Port &&
+		sc.ServerAliveInterval == other.ServerAliveInterval &&
+		sc.ServerAliveCountMax == other.ServerAliveCountMax &&
+		sc.ConnectTimeout == other.ConnectTimeout &&
+		slices.Equal(sc.Ciphers, other.Ciphers) &&
+		sc.HostKey.Equal(other.HostKey) &&
+		sc.JumpHost.Equal(other.JumpHost)
 }
 
 // This function dials an SSH connection recursively through jump hosts.
 // Returns the SSH client and a cleanup function that closes all connections.
-func (sc *sshConnection) Dial(network, addr string) (*ssh.Client, func(), error) {
+// Dialing and handshaking with every hop are aborted when ctx is done.
+func (sc *sshConnection) Dial(ctx context.Context, network, addr string) (*ssh.Client, func(), error) {
+	client, _, cleanup, err := sc.dial(ctx, network)
+	return client, cleanup, err
+}
+
+// dial connects to the hop, through its jump host if it has one, and also
+// returns the host key the hop presented. Jump hosts are shared with the
+// other chains that go through them.
+func (sc *sshConnection) dial(ctx context.Context, network string) (*ssh.Client, ssh.PublicKey, func(), error) {
+	verify, err := sc.HostKey.callback()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to load pinned host keys: %w", err)
+	}
+	var hostKey ssh.PublicKey
+	hostKeyCallback := recordingHostKeyCallback(verify, &hostKey)
+	hostPort := fmt.Sprintf("%s:%d", sc.HostName, sc.Port)
+
 	if sc.JumpHost == nil {
 		config, cleanup, err := authFromAgent()
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to create auth from agent: %w", err)
+			return nil, nil, nil, fmt.Errorf("failed to create auth from agent: %w", err)
 		}
 		defer cleanup()
 
 		sshConfig := &ssh.ClientConfig{
+			Config:          ssh.Config{Ciphers: sc.Ciphers},
 			User:            sc.User,
 			Auth:            []ssh.AuthMethod{config},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(), // This code is insecure; use a proper host key callback in production
+			HostKeyCallback: hostKeyCallback,
+		}
+		slog.InfoContext(ctx, "Dialing SSH connection", "hostname", sc.HostName, "port", sc.Port)
+		ctx, cancel, timedOut := withTimeout(ctx, sc.ConnectTimeout, connectTimeoutError)
+		defer cancel()
+		start := time.Now()
+		var d net.Dialer
+		ncc, err := d.DialContext(ctx, network, hostPort)
+		if err != nil {
+			err = timedOut(err)
+			metrics.observeSSHDial(sc.String(), start, err)
+			return nil, nil, nil, fmt.Errorf("failed to dial SSH connection: %w", err)
 		}
-		slog.Info("Dialing SSH connection", "hostname", sc.HostName, "port", sc.Port)
-		conn, err := ssh.Dial(network, fmt.Sprintf("%s:%d", sc.HostName, sc.Port), sshConfig)
+		conn, err := newClientContext(ctx, ncc, hostPort, sshConfig)
+		err = timedOut(err)
+		metrics.observeSSHDial(sc.String(), start, err)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to dial SSH connection: %w", err)
+			return nil, nil, nil, fmt.Errorf("failed to dial SSH connection: %w", err)
 		}
+		sc.startKeepAlive(conn)
 
-		return conn, func() { conn.Close() }, nil
+		return conn, hostKey, func() { conn.Close() }, nil
 	} else {
-		jumpClient, jumpCleanup, err := sc.JumpHost.Dial(network, "")
+		jumpClient, jumpCleanup, err := sharedHops.acquire(ctx, sc.JumpHost)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to dial jump host: %w", err)
+			return nil, nil, nil, fmt.Errorf("failed to dial jump host: %w", err)
 		}
-		ncc, err := jumpClient.Dial(network, fmt.Sprintf("%s:%d", sc.HostName, sc.Port))
+		start := time.Now()
+		slog.InfoContext(ctx, "Dialing SSH connection through jump host", "hostname", sc.HostName, "port", sc.Port, "jump", sc.JumpHost.HostName)
+		ctx, cancel, timedOut := withTimeout(ctx, sc.ConnectTimeout, connectTimeoutError)
+		defer cancel()
+		ncc, err := jumpClient.DialContext(ctx, network, hostPort)
 		if err != nil {
+			err = timedOut(err)
+			metrics.observeSSHDial(sc.String(), start, err)
 			jumpCleanup()
-			return nil, nil, fmt.Errorf("failed to dial target host through jump host: %w", err)
+			return nil, nil, nil, fmt.Errorf("failed to dial target host through jump host: %w", err)
 		}
 
 		config, cleanup, err := authFromAgent()
 		if err != nil {
+			ncc.Close()
 			jumpCleanup()
-			return nil, nil, fmt.Errorf("failed to create auth from agent: %w", err)
+			return nil, nil, nil, fmt.Errorf("failed to create auth from agent: %w", err)
 		}
 		defer cleanup()
 
-		conn, chans, reqs, err := ssh.NewClientConn(ncc, fmt.Sprintf("%s:%d", sc.HostName, sc.Port), &ssh.ClientConfig{
+		client, err := newClientContext(ctx, ncc, hostPort, &ssh.ClientConfig{
+			Config:          ssh.Config{Ciphers: sc.Ciphers},
 			User:            sc.User,
 			Auth:            []ssh.AuthMethod{config},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(), // This code is insecure; use a proper host key callback in production
+			HostKeyCallback: hostKeyCallback,
 		})
+		err = timedOut(err)
+		metrics.observeSSHDial(sc.String(), start, err)
 		if err != nil {
 			jumpCleanup()
-			return nil, nil, fmt.Errorf("failed to create new SSH client connection: %w", err)
+			return nil, nil, nil, fmt.Errorf("failed to create new SSH client connection: %w", err)
 		}
+		sc.startKeepAlive(client)
 
-		client := ssh.NewClient(conn, chans, reqs)
-		// cleanupAll closes this connection and recursively closes all jump host connections
+		// cleanupAll closes this connection and releases the jump host connection
 		cleanupAll := func() {
 			client.Close()
-			jumpCleanup() // This recursively closes all jump host connections in the chain
+			jumpCleanup() // Releases the shared jump host, closing it once no chain uses it
+		}
+		return client, hostKey, cleanupAll, nil
+	}
+}
+
+// newClientContext runs the SSH handshake over ncc, closing it when ctx is
+// done before the handshake completes.
+func newClientContext(ctx context.Context, ncc net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	stop := context.AfterFunc(ctx, func() { ncc.Close() })
+	defer stop()
+
+	conn, chans, reqs, err := ssh.NewClientConn(ncc, addr, config)
+	if err != nil {
+		ncc.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		return client, cleanupAll, nil
+		return nil, err
 	}
+	return ssh.NewClient(conn, chans, reqs), nil
 }
 
 func authFromAgent() (ssh.AuthMethod, func(), error) {
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START in sd-daemon.h).
+const sdListenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// keyed by their FileDescriptorName. It returns nil when proxs was not
+// socket-activated. The environment variables are cleared so that they are
+// not inherited by child processes.
+func systemdListeners() (map[string][]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	listeners := make(map[string][]net.Listener)
+	for i := range n {
+		// systemd names unnamed sockets "unknown".
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(sdListenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %d (%s): %w", sdListenFDsStart+i, name, err)
+		}
+		listeners[name] = append(listeners[name], ln)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state change to the service manager. It does nothing
+// when NOTIFY_SOCKET is unset, i.e. when proxs is not run by systemd with
+// Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading '@' denotes a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often the watchdog must be pinged, or 0
+// when the watchdog is not enabled for this process. Pings are sent at half
+// the configured timeout, as recommended by sd_watchdog_enabled(3).
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings the systemd watchdog every interval for as long as the
+// SSH pools can be health-checked within that interval. Dead SSH clients
+// are dropped by the check and redialed on the next request, so an
+// unreachable bastion does not get proxs restarted; a hung process does.
+// At most one check runs at a time: while one is outstanding, ticks wait
+// for it instead of starting another.
+func runWatchdog(ctx context.Context, interval time.Duration, pools func() []*sshPool) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var done chan int // result of the outstanding check, if any
+	var checked int   // number of pools it checks
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if done == nil {
+			current := pools()
+			done, checked = make(chan int, 1), len(current)
+			go func() {
+				healthy := 0
+				for _, p := range current {
+					if err := p.Check(); err != nil {
+						slog.Warn("SSH health check failed", "error", err)
+						continue
+					}
+					healthy++
+				}
+				done <- healthy
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case healthy := <-done:
+			done = nil
+			state := fmt.Sprintf("WATCHDOG=1\nSTATUS=%d/%d proxies healthy", healthy, checked)
+			if err := sdNotify(state); err != nil {
+				slog.Warn("Failed to notify systemd watchdog", "error", err)
+			}
+		case <-time.After(interval):
+			slog.Error("SSH health check did not complete in time, skipping watchdog ping")
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens on a unixgram socket and points NOTIFY_SOCKET at
+// it for the duration of the test.
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn := fakeNotifySocket(t)
+
+	for _, state := range []string{"READY=1", "STOPPING=1"} {
+		if err := sdNotify(state); err != nil {
+			t.Fatalf("sdNotify(%q) unexpected error: %v", state, err)
+		}
+		if got := readNotification(t, conn); got != state {
+			t.Errorf("sdNotify() sent %q, expected %q", got, state)
+		}
+	}
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify() without NOTIFY_SOCKET returned error: %v", err)
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		usec     string
+		pid      string
+		expected time.Duration
+	}{
+		{"Disabled", "", "", 0},
+		{"Enabled", "10000000", "", 5 * time.Second},
+		{"Enabled for this process", "2000000", strconv.Itoa(os.Getpid()), time.Second},
+		{"Enabled for another process", "2000000", "1", 0},
+		{"Invalid", "abc", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			if got := sdWatchdogInterval(); got != tt.expected {
+				t.Errorf("sdWatchdogInterval() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	conn := fakeNotifySocket(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A pool that has not dialed yet is healthy.
+	pools := []*sshPool{newSSHPool("env1", &sshConnection{HostName: "example.com"})}
+	go runWatchdog(ctx, 10*time.Millisecond, func() []*sshPool { return pools })
+
+	got := readNotification(t, conn)
+	if !strings.HasPrefix(got, "WATCHDOG=1\n") || !strings.Contains(got, "1/1 proxies healthy") {
+		t.Errorf("runWatchdog() sent %q", got)
+	}
+}
+
+func TestRunWatchdogHungCheck(t *testing.T) {
+	conn := fakeNotifySocket(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Check blocks until the pool is unlocked.
+	pool := newSSHPool("env1", &sshConnection{HostName: "example.com"})
+	pool.mu.Lock()
+	before := runtime.NumGoroutine()
+	go runWatchdog(ctx, 5*time.Millisecond, func() []*sshPool { return []*sshPool{pool} })
+
+	time.Sleep(100 * time.Millisecond)
+	if started := runtime.NumGoroutine() - before; started > 3 {
+		t.Errorf("%d goroutines started while a check hung, expected at most one check at a time", started)
+	}
+
+	pool.mu.Unlock()
+	if got := readNotification(t, conn); !strings.Contains(got, "1/1 proxies healthy") {
+		t.Errorf("runWatchdog() sent %q once the check completed", got)
+	}
+}
+
+func TestLoadConfigSocketActivation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"Named listener without port", "[[listener]]\nname = \"proxs\"\n"},
+		{"No port nor listener", "shutdown_timeout = \"5s\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			writeTestFile(t, path, tt.config)
+			cfg, err := LoadConfigFile(path)
+			if err != nil {
+				t.Fatalf("LoadConfigFile() = %v, expected the config to be accepted", err)
+			}
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bound, err := openListeners(cfg, map[string][]net.Listener{"proxs": {ln}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			if len(bound) != 1 || bound[0].Listener != ln {
+				t.Errorf("expected the passed socket to be served, got %+v", bound)
+			}
+
+			if _, err := openListeners(cfg, nil); err == nil {
+				t.Error("openListeners() without passed sockets expected an error, but got none")
+			}
+		})
+	}
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+
+	listeners, err := systemdListeners()
+	if err != nil || listeners != nil {
+		t.Errorf("systemdListeners() = %v, %v, expected nothing for another process", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("systemdListeners() did not clear LISTEN_FDS")
+	}
+}
+
+func TestOpenListenersInherited(t *testing.T) {
+	inheritedLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strayLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{Listeners: []ListenerConfig{
+		{Name: "proxs.socket", Protocol: protocolHTTP},
+		{Address: "127.0.0.1", Port: 0, Protocol: protocolSOCKS5},
+	}}
+	// Port 0 is rejected by validate for unnamed listeners but lets the
+	// test listen anywhere.
+	listeners, err := openListeners(cfg, map[string][]net.Listener{
+		"proxs.socket": {inheritedLn},
+		"stray":        {strayLn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(listeners))
+	}
+	if listeners[0].Listener != inheritedLn || listeners[0].cfg.Protocol != protocolHTTP {
+		t.Errorf("expected the inherited socket to serve the named listener")
+	}
+	if _, err := strayLn.Accept(); err == nil {
+		t.Errorf("expected the unmatched inherited socket to be closed")
+	}
+}
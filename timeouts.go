@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultHandshakeTimeout   = 10 * time.Second
+	defaultConnectTimeout     = 15 * time.Second
+	defaultChannelOpenTimeout = 10 * time.Second
+)
+
+// The timeout errors wrap context.DeadlineExceeded, so that clients are
+// answered with a TTL expired or gateway timeout reply.
+var (
+	handshakeTimeoutError   = fmt.Errorf("handshake timed out: %w", context.DeadlineExceeded)
+	connectTimeoutError     = fmt.Errorf("SSH connect timed out: %w", context.DeadlineExceeded)
+	channelOpenTimeoutError = fmt.Errorf("channel open timed out: %w", context.DeadlineExceeded)
+)
+
+var idleTimeoutError = errors.New("idle timeout exceeded")
+var sessionExpiredError = errors.New("maximum session lifetime exceeded")
+
+// TimeoutConfig bounds each phase of a client connection:
+//
+//   - Handshake: the SOCKS5 or HTTP negotiation with the client.
+//   - Connect: the TCP connection and SSH handshake of each hop, unless
+//     ConnectTimeout is set for the host in ssh_config.
+//   - ChannelOpen: opening the channel to the destination over SSH.
+//   - Idle: relaying with no bytes in either direction.
+//   - MaxLifetime: the whole session.
+//
+// Idle and MaxLifetime are unbounded unless set; the others have defaults.
+type TimeoutConfig struct {
+	Handshake   time.Duration `toml:"handshake"`
+	Connect     time.Duration `toml:"connect"`
+	ChannelOpen time.Duration `toml:"channel_open"`
+	Idle        time.Duration `toml:"idle"`
+	MaxLifetime time.Duration `toml:"max_lifetime"`
+}
+
+func (tc TimeoutConfig) validate() error {
+	for _, d := range []time.Duration{tc.Handshake, tc.Connect, tc.ChannelOpen, tc.Idle, tc.MaxLifetime} {
+		if d < 0 {
+			return fmt.Errorf("timeouts cannot be negative")
+		}
+	}
+	return nil
+}
+
+func (tc TimeoutConfig) handshake() time.Duration {
+	if tc.Handshake == 0 {
+		return defaultHandshakeTimeout
+	}
+	return tc.Handshake
+}
+
+func (tc TimeoutConfig) connect() time.Duration {
+	if tc.Connect == 0 {
+		return defaultConnectTimeout
+	}
+	return tc.Connect
+}
+
+func (tc TimeoutConfig) channelOpen() time.Duration {
+	if tc.ChannelOpen == 0 {
+		return defaultChannelOpenTimeout
+	}
+	return tc.ChannelOpen
+}
+
+// withTimeout bounds ctx by d, if d is not zero. The returned function
+// maps an error caused by this deadline, rather than by ctx, to timeoutErr.
+func withTimeout(ctx context.Context, d time.Duration, timeoutErr error) (context.Context, context.CancelFunc, func(error) error) {
+	if d == 0 {
+		return ctx, func() {}, func(err error) error { return err }
+	}
+	tctx, cancel := context.WithTimeoutCause(ctx, d, timeoutErr)
+	return tctx, cancel, func(err error) error {
+		if err != nil && ctx.Err() == nil && context.Cause(tctx) == timeoutErr {
+			return fmt.Errorf("%w after %s", timeoutErr, d)
+		}
+		return err
+	}
+}
+
+// watchIdle cancels the session once no bytes have been relayed in either
+// direction for idle, until ctx is done.
+func (sess *session) watchIdle(ctx context.Context, idle time.Duration) {
+	sess.touch()
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		left := idle - time.Since(time.Unix(0, sess.lastActive.Load()))
+		if left <= 0 {
+			sess.cancel(idleTimeoutError)
+			return
+		}
+		timer.Reset(left)
+	}
+}
+
+// touch records that bytes were relayed.
+func (sess *session) touch() {
+	sess.lastActive.Store(time.Now().UnixNano())
+}
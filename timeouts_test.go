@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bean1310/proxs/internal/sshtest"
+)
+
+func TestTimeoutConfig(t *testing.T) {
+	var tc TimeoutConfig
+	if tc.handshake() != defaultHandshakeTimeout || tc.connect() != defaultConnectTimeout || tc.channelOpen() != defaultChannelOpenTimeout {
+		t.Errorf("zero TimeoutConfig does not use the defaults")
+	}
+	tc = TimeoutConfig{Handshake: time.Second, Connect: 2 * time.Second, ChannelOpen: 3 * time.Second}
+	if tc.handshake() != time.Second || tc.connect() != 2*time.Second || tc.channelOpen() != 3*time.Second {
+		t.Errorf("configured timeouts are not used")
+	}
+	if err := (TimeoutConfig{Idle: -time.Second}).validate(); err == nil {
+		t.Error("expected an error for a negative timeout")
+	}
+}
+
+func TestNegotiateHandshakeTimeout(t *testing.T) {
+	for _, protocol := range []string{protocolSOCKS5, protocolHTTP, protocolMixed} {
+		t.Run(protocol, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			// The client never sends its greeting.
+			_, err := negotiate(context.Background(), newBufferedConn(server), ListenerConfig{Protocol: protocol}, 20*time.Millisecond)
+			if !errors.Is(err, handshakeTimeoutError) {
+				t.Errorf("negotiate() error = %v, expected %v", err, handshakeTimeoutError)
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("negotiate() error = %v, expected it to wrap %v", err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
+
+func TestAbortOnDoneRace(t *testing.T) {
+	// The handshake completes just as its context is done: the deadline
+	// set to abort it must not outlive it.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	stop := abortOnDone(ctx, server)
+	time.Sleep(10 * time.Millisecond)
+	stop()
+
+	go client.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := server.Read(buf); err != nil {
+		t.Errorf("Read() after stop() = %v, expected the connection to be usable", err)
+	}
+}
+
+func TestWatchIdle(t *testing.T) {
+	srv := newServer(&Config{Proxies: map[string]sshProxy{}}, nil)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	sess, ctx := srv.sessions.add(context.Background(), server, "127.0.0.1:1080")
+	defer srv.sessions.remove(sess)
+
+	const idle = 50 * time.Millisecond
+	go sess.watchIdle(ctx, idle)
+
+	// Activity keeps the session open past the idle timeout.
+	deadline := time.Now().Add(3 * idle)
+	for time.Now().Before(deadline) {
+		sess.touch()
+		time.Sleep(idle / 5)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("active session was cancelled")
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("idle session was not cancelled")
+	}
+	if cause := context.Cause(ctx); cause != idleTimeoutError {
+		t.Errorf("context.Cause() = %v, expected %v", cause, idleTimeoutError)
+	}
+	if reason := closeReasonFor(context.Cause(ctx)); reason != closeIdle {
+		t.Errorf("closeReasonFor() = %q, expected %q", reason, closeIdle)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	sshtest.UseAgent(t)
+
+	// The server accepts TCP connections but never starts the SSH handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	sc := &sshConnection{HostName: "127.0.0.1", User: "test", Port: ln.Addr().(*net.TCPAddr).Port, ConnectTimeout: 50 * time.Millisecond}
+	_, _, err = sc.Dial(context.Background(), "tcp", "")
+	if !errors.Is(err, connectTimeoutError) {
+		t.Errorf("Dial() error = %v, expected %v", err, connectTimeoutError)
+	}
+}
+
+func TestChannelOpenTimeout(t *testing.T) {
+	sshtest.UseAgent(t)
+	target := sshtest.NewServer(t)
+	target.Stall(true)
+
+	pool := newProxyPool(sshProxy{Name: "env1", Connections: []*sshConnection{sshConn(target, nil)}, channelOpenTimeout: 50 * time.Millisecond})
+	defer pool.Close()
+	_, err := pool.Dial(context.Background(), "tcp", "example.com:80")
+	if !errors.Is(err, channelOpenTimeoutError) {
+		t.Errorf("Dial() error = %v, expected %v", err, channelOpenTimeoutError)
+	}
+	if reply := socksReplyFor(err); reply != socksTTLExpired {
+		t.Errorf("socksReplyFor() = %#x, expected %#x", reply, socksTTLExpired)
+	}
+}
+
+func TestConnectTimeoutFromSSHConfig(t *testing.T) {
+	sshConfig := filepath.Join(t.TempDir(), "ssh_config")
+	writeTestFile(t, sshConfig, `
+Host bastion
+    ConnectTimeout 5
+Host env1
+    ProxyJump bastion
+`)
+	t.Setenv("SSH_CONFIG_FILE", sshConfig)
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	writeTestFile(t, configPath, `
+port = 1080
+
+[timeouts]
+connect = "20s"
+
+[proxy.env1]
+host = "env1"
+target_addrs = ["*.internal"]
+`)
+
+	cfg, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := cfg.Proxies["env1"].Connection
+	if sc.ConnectTimeout != 20*time.Second {
+		t.Errorf("env1 ConnectTimeout = %v, expected 20s", sc.ConnectTimeout)
+	}
+	if sc.JumpHost.ConnectTimeout != 5*time.Second {
+		t.Errorf("bastion ConnectTimeout = %v, expected 5s", sc.JumpHost.ConnectTimeout)
+	}
+	if cfg.Proxies["env1"].channelOpenTimeout != defaultChannelOpenTimeout {
+		t.Errorf("channel open timeout = %v, expected %v", cfg.Proxies["env1"].channelOpenTimeout, defaultChannelOpenTimeout)
+	}
+}